@@ -18,6 +18,12 @@ var (
 	LinuxDOClientSecret = getEnv("LINUXDO_CLIENT_SECRET", "")
 	CORSAllowOrigins    = getEnv("CORS_ALLOW_ORIGINS", "http://localhost:5173,http://127.0.0.1:5173")
 	TrustedProxies      = getEnv("TRUSTED_PROXIES", "")
+	RateLimitBackend    = getEnv("RATE_LIMIT_BACKEND", "memory")
+	RedisURL            = getEnv("REDIS_URL", "")
+	ShutdownTimeout     = getEnvInt("SHUTDOWN_TIMEOUT", 30)
+	LogSpoolPath        = getEnv("LOG_SPOOL_PATH", "data/log_spool.jsonl")
+	MetricsToken        = getEnv("METRICS_TOKEN", "")
+	MetricsAllowIPs     = getEnv("METRICS_ALLOW_IPS", "")
 )
 
 func getEnv(key, defaultValue string) string {
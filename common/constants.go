@@ -13,4 +13,12 @@ const (
 	DefaultRPM        = 60
 
 	KeyPrefix = "sk-cpa-"
+
+	QuotaModeRequest = "request"
+	QuotaModeToken   = "token"
+
+	QuotaPeriodNone    = "none"
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodWeekly  = "weekly"
+	QuotaPeriodMonthly = "monthly"
 )
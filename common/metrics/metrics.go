@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cpa_requests_total",
+		Help: "Proxied requests by model, status code and channel.",
+	}, []string{"model", "status", "channel"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cpa_request_duration_seconds",
+		Help:    "Proxied request latency by model, status code and channel.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"model", "status", "channel"})
+
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cpa_upstream_errors_total",
+		Help: "Failed upstream attempts by channel and reason.",
+	}, []string{"channel", "reason"})
+
+	UpstreamRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cpa_upstream_retries_total",
+		Help: "Retry rounds started after every channel failed.",
+	})
+
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cpa_tokens_total",
+		Help: "Tokens used by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	Rejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cpa_rejections_total",
+		Help: "Requests rejected before reaching the upstream, by source and reason.",
+	}, []string{"source", "reason"})
+
+	LogsSpooled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cpa_logs_spooled_total",
+		Help: "Log entries written to the spool file instead of the database.",
+	})
+
+	LogsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cpa_logs_dropped_total",
+		Help: "Log entries that could not be saved to the database or the spool.",
+	})
+
+	ActiveStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cpa_active_streams",
+		Help: "Streaming responses currently being proxied.",
+	})
+)
+
+// RegisterGaugeFunc exposes a value owned by another package as a gauge.
+func RegisterGaugeFunc(name string, help string, fn func() float64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	}, fn)
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"cpa-distribution/common/utils"
+	"cpa-distribution/model"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// analyticsMaxRange bounds the range of one query per granularity.
+var analyticsMaxRange = map[string]time.Duration{
+	model.GranularityHour:  31 * 24 * time.Hour,
+	model.GranularityDay:   366 * 24 * time.Hour,
+	model.GranularityMonth: 5 * 366 * 24 * time.Hour,
+}
+
+var analyticsMetrics = []string{"requests", "tokens", "error_rate", "p50_latency", "p95_latency"}
+
+// AdminGetAnalytics returns usage time series over all users, optionally
+// filtered by user_id.
+func AdminGetAnalytics(c *gin.Context) {
+	userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+	getAnalytics(c, uint(userID), []string{model.GroupByModel, model.GroupByUser, model.GroupByToken, model.GroupByStatusClass, model.GroupByIP})
+}
+
+// GetAnalytics returns usage time series of the current user.
+func GetAnalytics(c *gin.Context) {
+	getAnalytics(c, c.GetUint("user_id"), []string{model.GroupByModel, model.GroupByToken, model.GroupByStatusClass, model.GroupByIP})
+}
+
+// getAnalytics parses start/end (Unix seconds, default the last 7 days),
+// granularity (hour, day or month), group_by, metrics (comma separated) and
+// limit, and answers with a point per bucket for every series.
+func getAnalytics(c *gin.Context, userID uint, groupBys []string) {
+	end := time.Now()
+	if v := c.Query("end"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			utils.SendError(c, http.StatusBadRequest, "无效的结束时间")
+			return
+		}
+		end = time.Unix(ts, 0)
+	}
+	start := end.AddDate(0, 0, -7)
+	if v := c.Query("start"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			utils.SendError(c, http.StatusBadRequest, "无效的开始时间")
+			return
+		}
+		start = time.Unix(ts, 0)
+	}
+	if !start.Before(end) {
+		utils.SendError(c, http.StatusBadRequest, "开始时间必须早于结束时间")
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", model.GranularityDay)
+	maxRange, ok := analyticsMaxRange[granularity]
+	if !ok {
+		utils.SendError(c, http.StatusBadRequest, "无效的时间粒度")
+		return
+	}
+	if end.Sub(start) > maxRange {
+		utils.SendError(c, http.StatusBadRequest, "时间范围过大，请缩小范围或使用更粗的粒度")
+		return
+	}
+
+	groupBy := c.Query("group_by")
+	if groupBy != "" && !slices.Contains(groupBys, groupBy) {
+		utils.SendError(c, http.StatusBadRequest, "无效的分组维度")
+		return
+	}
+
+	metrics := analyticsMetrics
+	if v := c.Query("metrics"); v != "" {
+		metrics = strings.Split(v, ",")
+		for _, m := range metrics {
+			if !slices.Contains(analyticsMetrics, m) {
+				utils.SendError(c, http.StatusBadRequest, "无效的指标: "+m)
+				return
+			}
+		}
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+
+	series, err := model.GetAnalytics(model.AnalyticsQuery{
+		Start:       start,
+		End:         end,
+		Granularity: granularity,
+		GroupBy:     groupBy,
+		UserID:      userID,
+		Limit:       limit,
+		Percentiles: slices.Contains(metrics, "p50_latency") || slices.Contains(metrics, "p95_latency"),
+	})
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "获取统计数据失败")
+		return
+	}
+
+	result := make([]gin.H, 0, len(series))
+	for _, s := range series {
+		points := make([]gin.H, 0, len(s.Points))
+		for _, p := range s.Points {
+			point := gin.H{"time": p.Time}
+			values := gin.H{
+				"requests":    p.Requests,
+				"tokens":      p.Tokens,
+				"error_rate":  p.ErrorRate,
+				"p50_latency": p.P50Latency,
+				"p95_latency": p.P95Latency,
+			}
+			for _, m := range metrics {
+				point[m] = values[m]
+			}
+			points = append(points, point)
+		}
+		result = append(result, gin.H{"key": s.Key, "points": points})
+	}
+
+	utils.SendSuccess(c, gin.H{
+		"start":       start.Unix(),
+		"end":         end.Unix(),
+		"granularity": granularity,
+		"group_by":    groupBy,
+		"metrics":     metrics,
+		"buckets":     model.AnalyticsBuckets(start, end, granularity),
+		"series":      result,
+	})
+}
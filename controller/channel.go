@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"cpa-distribution/common"
+	"cpa-distribution/common/utils"
+	"cpa-distribution/model"
+	"cpa-distribution/service"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type channelRequest struct {
+	Name     *string `json:"name"`
+	BaseURL  *string `json:"base_url"`
+	Key      *string `json:"key"`
+	Weight   *int    `json:"weight"`
+	Priority *int    `json:"priority"`
+	Status   *int    `json:"status"`
+}
+
+func ListChannels(c *gin.Context) {
+	channels, err := model.GetAllChannels()
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "获取渠道列表失败")
+		return
+	}
+	utils.SendSuccess(c, channels)
+}
+
+func CreateChannel(c *gin.Context) {
+	var req channelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	if req.BaseURL == nil || req.Key == nil || strings.TrimSpace(*req.Key) == "" {
+		utils.SendError(c, http.StatusBadRequest, "渠道地址和密钥不能为空")
+		return
+	}
+
+	channel := &model.Channel{
+		Weight: 1,
+		Status: common.StatusEnabled,
+	}
+	if msg := applyChannelRequest(channel, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := channel.Insert(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "创建渠道失败")
+		return
+	}
+
+	service.RefreshChannelCache()
+
+	utils.SendSuccess(c, channel)
+}
+
+func UpdateChannel(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	channel, err := model.GetChannelByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "渠道不存在")
+		return
+	}
+
+	var req channelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误")
+		return
+	}
+	if msg := applyChannelRequest(channel, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := channel.Update(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "更新渠道失败")
+		return
+	}
+
+	service.RefreshChannelCache()
+
+	utils.SendSuccess(c, channel)
+}
+
+func DeleteChannel(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	channel, err := model.GetChannelByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "渠道不存在")
+		return
+	}
+
+	if err := channel.Delete(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "删除渠道失败")
+		return
+	}
+
+	service.RefreshChannelCache()
+
+	utils.SendMessage(c, "渠道已删除")
+}
+
+// applyChannelRequest copies the provided fields onto channel and returns a
+// validation message, or "" when the result is valid.
+func applyChannelRequest(channel *model.Channel, req channelRequest) string {
+	if req.Name != nil {
+		channel.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.BaseURL != nil {
+		baseURL := strings.TrimRight(strings.TrimSpace(*req.BaseURL), "/")
+		parsed, err := url.Parse(baseURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			parsed.RawQuery != "" || parsed.Fragment != "" {
+			return "无效的渠道地址"
+		}
+		channel.BaseURL = baseURL
+	}
+	if req.Key != nil && strings.TrimSpace(*req.Key) != "" {
+		channel.Key = strings.TrimSpace(*req.Key)
+	}
+	if req.Weight != nil {
+		if *req.Weight < 1 {
+			return "权重必须大于 0"
+		}
+		channel.Weight = *req.Weight
+	}
+	if req.Priority != nil {
+		channel.Priority = *req.Priority
+	}
+	if req.Status != nil {
+		channel.Status = *req.Status
+	}
+	return ""
+}
+
+func GetUpstreamStatus(c *gin.Context) {
+	utils.SendSuccess(c, gin.H{
+		"config":   service.GetHealthConfig(),
+		"channels": service.GetChannelHealth(),
+	})
+}
@@ -29,6 +29,7 @@ func GetDashboard(c *gin.Context) {
 			"role":         user.Role,
 			"quota_total":  user.QuotaTotal,
 			"quota_used":   user.QuotaUsed,
+			"balance":      user.Balance,
 		},
 		"stats": stats,
 		"token_count": tokenCount,
@@ -40,38 +41,27 @@ func GetDashboard(c *gin.Context) {
 		userCount := model.GetUserCount()
 
 		// Recent requests trend (last 7 days)
-		var trend []gin.H
-		for i := 6; i >= 0; i-- {
-			day := time.Now().AddDate(0, 0, -i).Truncate(24 * time.Hour)
-			nextDay := day.AddDate(0, 0, 1)
-			var count int64
-			model.DB.Model(&model.RequestLog{}).
-				Where("created_at >= ? AND created_at < ?", day, nextDay).
-				Count(&count)
-			trend = append(trend, gin.H{
-				"date":  day.Format("01-02"),
-				"count": count,
-			})
+		trend, _ := model.GetUsageTrend(7)
+		for i := range trend {
+			trend[i].Date = trend[i].Date[5:]
 		}
 
 		// Model distribution
-		type ModelCount struct {
-			Model string `json:"model"`
-			Count int64  `json:"count"`
+		modelDist, _ := model.GetTopModels(10)
+
+		// Stream latency percentiles (last 24 hours)
+		since := time.Now().Add(-24 * time.Hour)
+		modelLatency, channelLatency, _ := model.GetStreamLatencyStats(since)
+		if len(modelLatency) > 10 {
+			modelLatency = modelLatency[:10]
 		}
-		var modelDist []ModelCount
-		model.DB.Model(&model.RequestLog{}).
-			Select("model, COUNT(*) as count").
-			Where("model != ''").
-			Group("model").
-			Order("count DESC").
-			Limit(10).
-			Scan(&modelDist)
 
 		data["global_stats"] = globalStats
 		data["user_count"] = userCount
 		data["trend"] = trend
 		data["model_distribution"] = modelDist
+		data["model_latency"] = modelLatency
+		data["channel_latency"] = channelLatency
 	}
 
 	utils.SendSuccess(c, data)
@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"cpa-distribution/common/utils"
+	"cpa-distribution/model"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportFlushEvery is how many rows are written between flushes to the client.
+const exportFlushEvery = 500
+
+var logExportHeader = []string{
+	"id", "created_at", "user_id", "token_id", "channel_id", "request_ip", "method", "path",
+	"model", "upstream_model", "status_code", "attempts", "is_stream", "duration", "first_token_time",
+	"prompt_tokens", "completion_tokens", "total_tokens", "cost", "error_type", "error_message",
+}
+
+var monthlyExportHeader = []string{
+	"month", "user_id", "username", "requests", "errors",
+	"prompt_tokens", "completion_tokens", "total_tokens", "cost",
+}
+
+// ExportUserLogs exports the current user's logs or monthly usage.
+func ExportUserLogs(c *gin.Context) {
+	filter, ok := parseLogFilter(c)
+	if !ok {
+		return
+	}
+	filter.UserID = c.GetUint("user_id")
+	exportLogs(c, filter)
+}
+
+// AdminExportLogs exports the logs or monthly usage of all users.
+func AdminExportLogs(c *gin.Context) {
+	filter, ok := parseLogFilter(c)
+	if !ok {
+		return
+	}
+	exportLogs(c, filter)
+}
+
+// exportLogs writes format=csv (default) or jsonl. report=monthly exports
+// per-user monthly totals instead of individual logs. Rows are written as
+// they are read, so errors after the first row can only end the download.
+func exportLogs(c *gin.Context, filter model.LogFilter) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "jsonl" {
+		utils.SendError(c, http.StatusBadRequest, "无效的导出格式")
+		return
+	}
+	report := c.DefaultQuery("report", "logs")
+	if report != "logs" && report != "monthly" {
+		utils.SendError(c, http.StatusBadRequest, "无效的报表类型")
+		return
+	}
+
+	// The monthly report is small; load it first so a failure can still be reported
+	var monthly []model.MonthlyUsage
+	if report == "monthly" {
+		var err error
+		if monthly, err = model.GetMonthlyUsage(filter); err != nil {
+			utils.SendError(c, http.StatusInternalServerError, "导出失败")
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", report, time.Now().Format("20060102-150405"), format)
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	w := newExportWriter(c, format)
+	var err error
+	if report == "monthly" {
+		err = exportMonthly(w, monthly)
+	} else {
+		err = exportLogRows(w, filter)
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		log.Printf("Log export failed: %v", err)
+	}
+}
+
+func exportLogRows(w *exportWriter, filter model.LogFilter) error {
+	if err := w.header(logExportHeader); err != nil {
+		return err
+	}
+	return model.EachLog(filter, func(l *model.RequestLog) error {
+		return w.row(l, []string{
+			strconv.FormatUint(uint64(l.ID), 10),
+			l.CreatedAt.Local().Format(time.RFC3339),
+			strconv.FormatUint(uint64(l.UserID), 10),
+			strconv.FormatUint(uint64(l.TokenID), 10),
+			strconv.FormatUint(uint64(l.ChannelID), 10),
+			csvSafe(l.RequestIP),
+			csvSafe(l.Method),
+			csvSafe(l.Path),
+			csvSafe(l.Model),
+			csvSafe(l.UpstreamModel),
+			strconv.Itoa(l.StatusCode),
+			strconv.Itoa(l.Attempts),
+			strconv.FormatBool(l.IsStream),
+			strconv.Itoa(l.Duration),
+			strconv.Itoa(l.FirstTokenTime),
+			strconv.Itoa(l.PromptTokens),
+			strconv.Itoa(l.CompletionTokens),
+			strconv.Itoa(l.TotalTokens),
+			strconv.FormatFloat(l.Cost, 'f', -1, 64),
+			csvSafe(l.ErrorType),
+			csvSafe(l.ErrorMessage),
+		})
+	})
+}
+
+func exportMonthly(w *exportWriter, rows []model.MonthlyUsage) error {
+	if err := w.header(monthlyExportHeader); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		err := w.row(r, []string{
+			r.Month,
+			strconv.FormatUint(uint64(r.UserID), 10),
+			csvSafe(r.Username),
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.Errors, 10),
+			strconv.FormatInt(r.PromptTokens, 10),
+			strconv.FormatInt(r.CompletionTokens, 10),
+			strconv.FormatInt(r.TotalTokens, 10),
+			strconv.FormatFloat(r.Cost, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportWriter writes rows as CSV records or JSON lines and flushes them to
+// the client periodically.
+type exportWriter struct {
+	c    *gin.Context
+	csv  *csv.Writer
+	json *json.Encoder
+	rows int
+}
+
+func newExportWriter(c *gin.Context, format string) *exportWriter {
+	w := &exportWriter{c: c}
+	if format == "csv" {
+		// BOM so spreadsheet apps detect UTF-8
+		c.Writer.WriteString("\ufeff")
+		w.csv = csv.NewWriter(c.Writer)
+	} else {
+		w.json = json.NewEncoder(c.Writer)
+	}
+	return w
+}
+
+func (w *exportWriter) header(columns []string) error {
+	if w.csv == nil {
+		return nil
+	}
+	return w.csv.Write(columns)
+}
+
+// row writes value as a JSON line, or record as a CSV record.
+func (w *exportWriter) row(value interface{}, record []string) error {
+	var err error
+	if w.csv != nil {
+		err = w.csv.Write(record)
+	} else {
+		err = w.json.Encode(value)
+	}
+	if err != nil {
+		return err
+	}
+	w.rows++
+	if w.rows%exportFlushEvery == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+// csvSafe keeps client-controlled text such as paths and error messages from
+// being evaluated as a formula by spreadsheet apps. Numeric fields are written
+// as is, so that negative values stay numbers.
+func csvSafe(field string) string {
+	if field != "" && strings.ContainsRune("=+-@\t\r", rune(field[0])) {
+		return "'" + field
+	}
+	return field
+}
+
+func (w *exportWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	w.c.Writer.Flush()
+	return nil
+}
@@ -6,35 +6,19 @@ import (
 	"cpa-distribution/service"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func ListUserLogs(c *gin.Context) {
-	userID := c.GetUint("user_id")
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
-	modelFilter := c.Query("model")
-
-	if page < 1 {
-		page = 1
-	}
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 20
-	}
-
-	logs, total, err := model.GetLogsByUserID(userID, page, pageSize, modelFilter)
-	if err != nil {
-		utils.SendError(c, http.StatusInternalServerError, "获取日志失败")
+	filter, ok := parseLogFilter(c)
+	if !ok {
 		return
 	}
-
-	utils.SendSuccess(c, gin.H{
-		"list":      logs,
-		"total":     total,
-		"page":      page,
-		"page_size": pageSize,
-	})
+	filter.UserID = c.GetUint("user_id")
+	listLogs(c, filter)
 }
 
 func GetUserLogStats(c *gin.Context) {
@@ -44,12 +28,20 @@ func GetUserLogStats(c *gin.Context) {
 }
 
 func AdminListLogs(c *gin.Context) {
+	filter, ok := parseLogFilter(c)
+	if !ok {
+		return
+	}
+	listLogs(c, filter)
+}
+
+// listLogs answers with a page of logs. Passing the returned next_cursor as
+// cursor fetches the following page by keyset, which stays fast on deep pages
+// and skips counting the total.
+func listLogs(c *gin.Context, filter model.LogFilter) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
-	userIDFilter, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
-	tokenIDFilter, _ := strconv.ParseUint(c.Query("token_id"), 10, 64)
-	modelFilter := c.Query("model")
-	ipFilter := c.Query("ip")
+	cursor, _ := strconv.ParseUint(c.Query("cursor"), 10, 64)
 
 	if page < 1 {
 		page = 1
@@ -58,22 +50,88 @@ func AdminListLogs(c *gin.Context) {
 		pageSize = 20
 	}
 
-	logs, total, err := model.GetAllLogs(page, pageSize, uint(userIDFilter), uint(tokenIDFilter), modelFilter, ipFilter)
+	logs, total, err := model.GetAllLogs(filter, page, pageSize, uint(cursor))
 	if err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "获取日志失败")
 		return
 	}
 
-	utils.SendSuccess(c, gin.H{
-		"list":      logs,
-		"total":     total,
-		"page":      page,
-		"page_size": pageSize,
-	})
+	var nextCursor uint
+	if len(logs) == pageSize {
+		nextCursor = logs[len(logs)-1].ID
+	}
+	data := gin.H{
+		"list":        logs,
+		"page_size":   pageSize,
+		"next_cursor": nextCursor,
+	}
+	if cursor == 0 {
+		data["total"] = total
+		data["page"] = page
+	}
+	utils.SendSuccess(c, data)
+}
+
+// parseLogFilter reads the log filters shared by listing and export: user_id,
+// token_id, model, ip, start and end (Unix seconds), status (a code such as
+// 429 or a class such as 5xx), path_prefix, min_duration (ms), errors_only
+// and error (a substring of the error message).
+func parseLogFilter(c *gin.Context) (model.LogFilter, bool) {
+	userID, _ := strconv.ParseUint(c.Query("user_id"), 10, 64)
+	tokenID, _ := strconv.ParseUint(c.Query("token_id"), 10, 64)
+	minDuration, _ := strconv.Atoi(c.Query("min_duration"))
+	errorsOnly, _ := strconv.ParseBool(c.Query("errors_only"))
+	filter := model.LogFilter{
+		UserID:        uint(userID),
+		TokenID:       uint(tokenID),
+		Model:         c.Query("model"),
+		IP:            c.Query("ip"),
+		PathPrefix:    c.Query("path_prefix"),
+		MinDuration:   minDuration,
+		ErrorsOnly:    errorsOnly,
+		ErrorContains: c.Query("error"),
+	}
+
+	if status := strings.ToLower(c.Query("status")); status != "" {
+		if class, found := strings.CutSuffix(status, "xx"); found && len(class) == 1 && class >= "1" && class <= "5" {
+			filter.StatusClass = int(class[0] - '0')
+		} else if code, err := strconv.Atoi(status); err == nil && code >= 100 && code <= 599 {
+			filter.StatusCode = code
+		} else {
+			utils.SendError(c, http.StatusBadRequest, "无效的状态码: "+status)
+			return filter, false
+		}
+	}
+
+	var ok bool
+	if filter.Start, ok = parseUnixQuery(c, "start"); !ok {
+		return filter, false
+	}
+	if filter.End, ok = parseUnixQuery(c, "end"); !ok {
+		return filter, false
+	}
+	return filter, true
+}
+
+// parseUnixQuery reads an optional Unix seconds query parameter, answering
+// 400 when it is invalid.
+func parseUnixQuery(c *gin.Context, param string) (*time.Time, bool) {
+	v := c.Query(param)
+	if v == "" {
+		return nil, true
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的时间: "+param)
+		return nil, false
+	}
+	t := time.Unix(ts, 0)
+	return &t, true
 }
 
 func AdminGetLogStats(c *gin.Context) {
 	stats := model.GetGlobalLogStats()
+	stats.SpoolDepth = service.LogSpoolDepth()
 	utils.SendSuccess(c, stats)
 }
 
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"cpa-distribution/common/utils"
+	"cpa-distribution/model"
+	"cpa-distribution/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type modelMappingRequest struct {
+	Pattern *string `json:"pattern"`
+	Target  *string `json:"target"`
+}
+
+func ListModelMappings(c *gin.Context) {
+	mappings, err := model.GetAllModelMappings()
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "获取模型映射失败")
+		return
+	}
+	utils.SendSuccess(c, mappings)
+}
+
+func CreateModelMapping(c *gin.Context) {
+	var req modelMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	if req.Pattern == nil || req.Target == nil {
+		utils.SendError(c, http.StatusBadRequest, "模型名称和目标模型不能为空")
+		return
+	}
+
+	mapping := &model.ModelMapping{}
+	if msg := applyModelMappingRequest(mapping, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := mapping.Insert(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "创建模型映射失败，映射可能已存在")
+		return
+	}
+
+	service.RefreshModelMappingCache()
+
+	utils.SendSuccess(c, mapping)
+}
+
+func UpdateModelMapping(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	mapping, err := model.GetModelMappingByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "模型映射不存在")
+		return
+	}
+
+	var req modelMappingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误")
+		return
+	}
+	if msg := applyModelMappingRequest(mapping, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := mapping.Update(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "更新模型映射失败")
+		return
+	}
+
+	service.RefreshModelMappingCache()
+
+	utils.SendSuccess(c, mapping)
+}
+
+func DeleteModelMapping(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	mapping, err := model.GetModelMappingByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "模型映射不存在")
+		return
+	}
+
+	if err := mapping.Delete(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "删除模型映射失败")
+		return
+	}
+
+	service.RefreshModelMappingCache()
+
+	utils.SendMessage(c, "模型映射已删除")
+}
+
+func applyModelMappingRequest(mapping *model.ModelMapping, req modelMappingRequest) string {
+	if req.Pattern != nil {
+		pattern := strings.TrimSpace(*req.Pattern)
+		if pattern == "" {
+			return "模型名称不能为空"
+		}
+		if strings.Count(pattern, "*") > 1 {
+			return "模型名称最多只能包含一个通配符 *"
+		}
+		mapping.Pattern = pattern
+	}
+	if req.Target != nil {
+		target := strings.TrimSpace(*req.Target)
+		if target == "" {
+			return "目标模型不能为空"
+		}
+		mapping.Target = target
+	}
+	if strings.Contains(mapping.Target, "*") && !strings.Contains(mapping.Pattern, "*") {
+		return "目标模型包含通配符时，模型名称也必须包含通配符"
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"cpa-distribution/common/utils"
+	"cpa-distribution/model"
+	"cpa-distribution/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type modelPriceRequest struct {
+	Model        *string  `json:"model"`
+	InputPrice   *float64 `json:"input_price"`
+	OutputPrice  *float64 `json:"output_price"`
+	PerCallPrice *float64 `json:"per_call_price"`
+}
+
+func ListModelPrices(c *gin.Context) {
+	prices, err := model.GetAllModelPrices()
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "获取模型价格失败")
+		return
+	}
+	utils.SendSuccess(c, prices)
+}
+
+func CreateModelPrice(c *gin.Context) {
+	var req modelPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误: "+err.Error())
+		return
+	}
+	if req.Model == nil || strings.TrimSpace(*req.Model) == "" {
+		utils.SendError(c, http.StatusBadRequest, "模型名称不能为空")
+		return
+	}
+
+	price := &model.ModelPrice{}
+	if msg := applyModelPriceRequest(price, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := price.Insert(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "创建模型价格失败，模型可能已存在")
+		return
+	}
+
+	service.RefreshPriceCache()
+
+	utils.SendSuccess(c, price)
+}
+
+func UpdateModelPrice(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	price, err := model.GetModelPriceByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "模型价格不存在")
+		return
+	}
+
+	var req modelPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.SendError(c, http.StatusBadRequest, "参数错误")
+		return
+	}
+	if msg := applyModelPriceRequest(price, req); msg != "" {
+		utils.SendError(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := price.Update(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "更新模型价格失败")
+		return
+	}
+
+	service.RefreshPriceCache()
+
+	utils.SendSuccess(c, price)
+}
+
+func DeleteModelPrice(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		utils.SendError(c, http.StatusBadRequest, "无效的ID")
+		return
+	}
+
+	price, err := model.GetModelPriceByID(uint(id))
+	if err != nil {
+		utils.SendError(c, http.StatusNotFound, "模型价格不存在")
+		return
+	}
+
+	if err := price.Delete(); err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "删除模型价格失败")
+		return
+	}
+
+	service.RefreshPriceCache()
+
+	utils.SendMessage(c, "模型价格已删除")
+}
+
+func applyModelPriceRequest(price *model.ModelPrice, req modelPriceRequest) string {
+	if req.Model != nil {
+		name := strings.TrimSpace(*req.Model)
+		if name == "" {
+			return "模型名称不能为空"
+		}
+		price.Model = name
+	}
+	if req.InputPrice != nil {
+		if *req.InputPrice < 0 {
+			return "价格不能为负数"
+		}
+		price.InputPrice = *req.InputPrice
+	}
+	if req.OutputPrice != nil {
+		if *req.OutputPrice < 0 {
+			return "价格不能为负数"
+		}
+		price.OutputPrice = *req.OutputPrice
+	}
+	if req.PerCallPrice != nil {
+		if *req.PerCallPrice < 0 {
+			return "价格不能为负数"
+		}
+		price.PerCallPrice = *req.PerCallPrice
+	}
+	return ""
+}
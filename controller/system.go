@@ -1,9 +1,13 @@
 package controller
 
 import (
+	"cpa-distribution/common"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
+	"cpa-distribution/service"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -26,14 +30,55 @@ func UpdateSettings(c *gin.Context) {
 
 	// Whitelist allowed setting keys
 	allowedKeys := map[string]bool{
-		"cpa_upstream_url":      true,
-		"cpa_upstream_key":      true,
-		"linuxdo_client_id":     true,
-		"linuxdo_client_secret": true,
-		"site_name":             true,
-		"min_trust_level":       true,
-		"default_quota":         true,
-		"log_retention_days":    true,
+		"cpa_upstream_url":                 true,
+		"cpa_upstream_key":                 true,
+		"linuxdo_client_id":                true,
+		"linuxdo_client_secret":            true,
+		"site_name":                        true,
+		"min_trust_level":                  true,
+		"default_quota":                    true,
+		"log_retention_days":               true,
+		"quota_mode":                       true,
+		"billing_enabled":                  true,
+		"default_balance":                  true,
+		"health_check_interval":            true,
+		"health_check_path":                true,
+		"breaker_failure_threshold":        true,
+		"breaker_cooldown":                 true,
+		"retry_max":                        true,
+		"retry_backoff_ms":                 true,
+		"retry_status_codes":               true,
+		"upstream_dial_timeout":            true,
+		"upstream_tls_timeout":             true,
+		"upstream_response_header_timeout": true,
+		"upstream_stream_idle_timeout":     true,
+		"max_request_body_mb":              true,
+		"max_response_body_mb":             true,
+	}
+
+	if mode, ok := req["quota_mode"]; ok && mode != "" && mode != common.QuotaModeRequest && mode != common.QuotaModeToken {
+		utils.SendError(c, http.StatusBadRequest, "无效的计费模式")
+		return
+	}
+	for _, key := range []string{"log_retention_days", "health_check_interval", "breaker_failure_threshold", "breaker_cooldown", "retry_max", "retry_backoff_ms",
+		"upstream_dial_timeout", "upstream_tls_timeout", "upstream_response_header_timeout", "upstream_stream_idle_timeout",
+		"max_request_body_mb", "max_response_body_mb"} {
+		if value, ok := req[key]; ok && value != "" {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				utils.SendError(c, http.StatusBadRequest, "无效的数值: "+key)
+				return
+			}
+		}
+	}
+	if path, ok := req["health_check_path"]; ok && path != "" && !strings.HasPrefix(path, "/") {
+		utils.SendError(c, http.StatusBadRequest, "健康检查路径必须以 / 开头")
+		return
+	}
+	if codes, ok := req["retry_status_codes"]; ok {
+		if _, err := service.ParseStatusCodes(codes); err != nil {
+			utils.SendError(c, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
 
 	filtered := make(map[string]string)
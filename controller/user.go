@@ -4,8 +4,10 @@ import (
 	"cpa-distribution/common"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
+	"cpa-distribution/service"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -34,6 +36,32 @@ func AdminListUsers(c *gin.Context) {
 	})
 }
 
+func AdminListQuotaHistory(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	subjectType := c.Query("subject_type")
+	subjectID, _ := strconv.ParseUint(c.Query("subject_id"), 10, 64)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	history, total, err := model.GetQuotaHistory(page, pageSize, subjectType, uint(subjectID))
+	if err != nil {
+		utils.SendError(c, http.StatusInternalServerError, "获取配额历史失败")
+		return
+	}
+
+	utils.SendSuccess(c, gin.H{
+		"list":      history,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
 func AdminUpdateUser(c *gin.Context) {
 	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
@@ -48,10 +76,15 @@ func AdminUpdateUser(c *gin.Context) {
 	}
 
 	var req struct {
-		Role       *int   `json:"role"`
-		Status     *int   `json:"status"`
-		QuotaTotal *int64 `json:"quota_total"`
-		TokenLimit *int   `json:"token_limit"`
+		Role           *int     `json:"role"`
+		Status         *int     `json:"status"`
+		QuotaTotal     *int64   `json:"quota_total"`
+		QuotaPeriod    *string  `json:"quota_period"`
+		QuotaTimezone  *string  `json:"quota_timezone"`
+		TokenLimit     *int     `json:"token_limit"`
+		Balance        *float64 `json:"balance"`
+		RateLimitTPM   *int     `json:"rate_limit_tpm"`
+		MaxConcurrency *int     `json:"max_concurrency"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		utils.SendError(c, http.StatusBadRequest, "参数错误")
@@ -65,24 +98,58 @@ func AdminUpdateUser(c *gin.Context) {
 		return
 	}
 
+	var columns []string
 	if req.Role != nil {
 		if *req.Role > currentRole {
 			utils.SendError(c, http.StatusForbidden, "无法设置高于自身的角色")
 			return
 		}
 		user.Role = *req.Role
+		columns = append(columns, "role")
 	}
 	if req.Status != nil {
 		user.Status = *req.Status
+		columns = append(columns, "status")
 	}
 	if req.QuotaTotal != nil {
 		user.QuotaTotal = *req.QuotaTotal
+		columns = append(columns, "quota_total")
+	}
+	if req.QuotaPeriod != nil || req.QuotaTimezone != nil {
+		if req.QuotaPeriod != nil {
+			user.QuotaPeriod = *req.QuotaPeriod
+		}
+		if req.QuotaTimezone != nil {
+			user.QuotaTimezone = *req.QuotaTimezone
+		}
+		if err := service.ValidateQuotaPeriod(user.QuotaPeriod, user.QuotaTimezone); err != nil {
+			utils.SendError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if user.QuotaPeriod == "" {
+			user.QuotaPeriod = common.QuotaPeriodNone
+		}
+		user.QuotaResetAt = service.NextQuotaReset(user.QuotaPeriod, user.QuotaTimezone, time.Now())
+		columns = append(columns, "quota_period", "quota_timezone", "quota_reset_at")
 	}
 	if req.TokenLimit != nil {
 		user.TokenLimit = *req.TokenLimit
+		columns = append(columns, "token_limit")
+	}
+	if req.Balance != nil {
+		user.Balance = *req.Balance
+		columns = append(columns, "balance")
+	}
+	if req.RateLimitTPM != nil {
+		user.RateLimitTPM = *req.RateLimitTPM
+		columns = append(columns, "rate_limit_tpm")
+	}
+	if req.MaxConcurrency != nil {
+		user.MaxConcurrency = *req.MaxConcurrency
+		columns = append(columns, "max_concurrency")
 	}
 
-	if err := user.Update(); err != nil {
+	if err := user.Update(columns...); err != nil {
 		utils.SendError(c, http.StatusInternalServerError, "更新失败")
 		return
 	}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"cpa-distribution/common"
 	"cpa-distribution/middleware"
 	"cpa-distribution/model"
+	"cpa-distribution/proxy"
 	"cpa-distribution/router"
 	"cpa-distribution/service"
 	"embed"
+	"errors"
+	"flag"
 	"io/fs"
 	"log"
 	"net/http"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -19,14 +26,30 @@ import (
 var webFS embed.FS
 
 func main() {
+	backfillUsage := flag.Bool("backfill-usage", false, "rebuild the daily usage rollup from request logs and exit; run while the server is stopped")
+	flag.Parse()
+
 	gin.SetMode(common.GinMode)
 
 	// Initialize database
 	model.InitDB()
+	if *backfillUsage {
+		backfill()
+		return
+	}
+	model.InitSettingCache()
 
 	// Initialize services
 	service.InitOAuth()
 	service.InitLogService()
+	service.InitLogSpool()
+	service.InitLogRetention()
+	service.InitUsageService()
+	service.InitChannelCache()
+	service.InitChannelHealth()
+	service.InitPriceCache()
+	service.InitModelMappingCache()
+	service.InitQuotaScheduler()
 
 	// Initialize IP ban cache
 	middleware.InitIPBanCache()
@@ -37,10 +60,62 @@ func main() {
 	// Serve embedded frontend
 	setupFrontend(r)
 
-	log.Printf("CPA Distribution System starting on port %s", common.Port)
-	if err := r.Run(":" + common.Port); err != nil {
-		log.Fatal("Failed to start server: ", err)
+	srv := &http.Server{
+		Addr:    ":" + common.Port,
+		Handler: r,
+	}
+
+	go func() {
+		log.Printf("CPA Distribution System starting on port %s", common.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server: ", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	shutdown(srv)
+}
+
+// backfill rebuilds UsageDaily from the request logs.
+func backfill() {
+	log.Printf("Backfilling daily usage rollup from request logs")
+	count, err := model.BackfillUsageDaily()
+	if err != nil {
+		log.Fatalf("Backfill failed after %d logs: %v", count, err)
+	}
+	log.Printf("Backfill finished: %d logs rolled up", count)
+	model.CloseDB()
+}
+
+// shutdown stops accepting requests, waits for in-flight requests and streams
+// up to SHUTDOWN_TIMEOUT, then writes buffered logs and usage before closing
+// the database.
+func shutdown(srv *http.Server) {
+	log.Printf("Shutting down, waiting up to %ds for in-flight requests", common.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(common.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown timed out, closing remaining connections: %v", err)
+		srv.Close()
 	}
+
+	// Closed streams still record their logs on the way out
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := proxy.WaitInFlight(waitCtx); err != nil {
+		log.Printf("Proxy requests still running after shutdown: %v", err)
+	}
+
+	service.StopLogService()
+	service.StopUsageService()
+	model.CloseDB()
+
+	log.Println("Server stopped")
 }
 
 func setupFrontend(r *gin.Engine) {
@@ -56,7 +131,7 @@ func setupFrontend(r *gin.Engine) {
 		path := c.Request.URL.Path
 
 		// Don't serve frontend for API or proxy routes
-		if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/v1/") {
+		if strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/v1/") || strings.HasPrefix(path, "/v1beta/") {
 			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 			return
 		}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
 	"log"
@@ -81,6 +82,7 @@ func IPCheck() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		clientIP := utils.GetClientIP(c)
 		if isIPBanned(clientIP) {
+			metrics.Rejections.WithLabelValues("ip_check", "ip_banned").Inc()
 			utils.SendOpenAIError(c, 403, "ip_banned", "Your IP has been banned")
 			c.Abort()
 			return
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"cpa-distribution/common"
+	"cpa-distribution/common/utils"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsAuth lets scrapers through with METRICS_TOKEN as a bearer token or from
+// an address in METRICS_ALLOW_IPS. With neither configured the endpoint is off.
+func MetricsAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if common.MetricsToken == "" && common.MetricsAllowIPs == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		if common.MetricsToken != "" {
+			auth := c.GetHeader("Authorization")
+			if strings.HasPrefix(auth, "Bearer ") {
+				token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+				if subtle.ConstantTimeCompare([]byte(token), []byte(common.MetricsToken)) == 1 {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		clientIP := utils.GetClientIP(c)
+		for _, allowedIP := range strings.Split(common.MetricsAllowIPs, ",") {
+			allowedIP = strings.TrimSpace(allowedIP)
+			if allowedIP != "" && utils.IsIPInCIDR(clientIP, allowedIP) {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+	}
+}
@@ -1,51 +1,231 @@
 package middleware
 
 import (
+	"context"
+	"cpa-distribution/common"
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// LimitResult describes the state of a sliding window after a check.
+type LimitResult struct {
+	Allowed   bool
+	Remaining int
+	// Reset is how long until the oldest entry leaves the window.
+	Reset time.Duration
+}
+
+// RateLimiter is the storage backend for per-key request, token and
+// concurrency limits.
+type RateLimiter interface {
+	// Allow records a hit for key if it still fits within limit hits per window.
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (LimitResult, error)
+	// AddUsage records amount units (e.g. tokens) for key.
+	AddUsage(ctx context.Context, key string, amount int, window time.Duration) error
+	// Usage returns the units recorded for key within window and how long until
+	// the oldest of them expires.
+	Usage(ctx context.Context, key string, window time.Duration) (int, time.Duration, error)
+	// Acquire takes one of limit concurrent slots for key and returns its id.
+	Acquire(ctx context.Context, key string, limit int) (string, bool, error)
+	// Refresh keeps a slot taken by Acquire from expiring while its request runs.
+	Refresh(ctx context.Context, key string, slot string) error
+	// Release frees a slot taken by Acquire.
+	Release(ctx context.Context, key string, slot string) error
+}
+
+type windowEntry struct {
+	at     time.Time
+	amount int
+}
+
 type slidingWindow struct {
-	timestamps []time.Time
-	mu         sync.Mutex
+	entries []windowEntry
+	mu      sync.Mutex
 }
 
-var (
-	rateLimitWindows = make(map[uint]*slidingWindow)
-	rlMutex          sync.RWMutex
-)
+// trim drops entries older than window and returns the sum of the rest.
+func (w *slidingWindow) trim(now time.Time, window time.Duration) int {
+	windowStart := now.Add(-window)
+	valid := make([]windowEntry, 0, len(w.entries))
+	total := 0
+	for _, e := range w.entries {
+		if e.at.After(windowStart) {
+			valid = append(valid, e)
+			total += e.amount
+		}
+	}
+	w.entries = valid
+	return total
+}
+
+func (w *slidingWindow) reset(now time.Time, window time.Duration) time.Duration {
+	if len(w.entries) == 0 {
+		return 0
+	}
+	return w.entries[0].at.Add(window).Sub(now)
+}
+
+// memoryLimiter keeps sliding windows in process memory. It is the default and
+// only correct for a single instance.
+type memoryLimiter struct {
+	windows  map[string]*slidingWindow
+	inFlight map[string]int
+	mu       sync.RWMutex
+	flightMu sync.Mutex
+}
 
-func getWindow(tokenID uint) *slidingWindow {
-	rlMutex.RLock()
-	w, exists := rateLimitWindows[tokenID]
-	rlMutex.RUnlock()
+func newMemoryLimiter() *memoryLimiter {
+	l := &memoryLimiter{
+		windows:  make(map[string]*slidingWindow),
+		inFlight: make(map[string]int),
+	}
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.cleanup()
+		}
+	}()
+	return l
+}
+
+func (l *memoryLimiter) getWindow(key string) *slidingWindow {
+	l.mu.RLock()
+	w, exists := l.windows[key]
+	l.mu.RUnlock()
 	if exists {
 		return w
 	}
 
-	rlMutex.Lock()
-	defer rlMutex.Unlock()
-	if w, exists = rateLimitWindows[tokenID]; exists {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, exists = l.windows[key]; exists {
 		return w
 	}
 	w = &slidingWindow{}
-	rateLimitWindows[tokenID] = w
+	l.windows[key] = w
 	return w
 }
 
-func RateLimit() gin.HandlerFunc {
-	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
-		for range ticker.C {
-			cleanupWindows()
+func (l *memoryLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (LimitResult, error) {
+	w := l.getWindow(key)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	count := w.trim(now, window)
+	if count >= limit {
+		return LimitResult{Allowed: false, Remaining: 0, Reset: w.reset(now, window)}, nil
+	}
+
+	w.entries = append(w.entries, windowEntry{at: now, amount: 1})
+	return LimitResult{Allowed: true, Remaining: limit - count - 1, Reset: w.reset(now, window)}, nil
+}
+
+func (l *memoryLimiter) AddUsage(ctx context.Context, key string, amount int, window time.Duration) error {
+	w := l.getWindow(key)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.trim(now, window)
+	w.entries = append(w.entries, windowEntry{at: now, amount: amount})
+	return nil
+}
+
+func (l *memoryLimiter) Usage(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	w := l.getWindow(key)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	return w.trim(now, window), w.reset(now, window), nil
+}
+
+// Slots of the memory limiter are plain counters; they cannot leak, so slot
+// ids are not tracked and Refresh does nothing.
+func (l *memoryLimiter) Acquire(ctx context.Context, key string, limit int) (string, bool, error) {
+	l.flightMu.Lock()
+	defer l.flightMu.Unlock()
+	if l.inFlight[key] >= limit {
+		return "", false, nil
+	}
+	l.inFlight[key]++
+	return "", true, nil
+}
+
+func (l *memoryLimiter) Refresh(ctx context.Context, key string, slot string) error {
+	return nil
+}
+
+func (l *memoryLimiter) Release(ctx context.Context, key string, slot string) error {
+	l.flightMu.Lock()
+	defer l.flightMu.Unlock()
+	if l.inFlight[key] <= 1 {
+		delete(l.inFlight, key)
+	} else {
+		l.inFlight[key]--
+	}
+	return nil
+}
+
+func (l *memoryLimiter) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, w := range l.windows {
+		w.mu.Lock()
+		if len(w.entries) == 0 || w.entries[len(w.entries)-1].at.Before(now.Add(-2*time.Minute)) {
+			delete(l.windows, key)
 		}
-	}()
+		w.mu.Unlock()
+	}
+}
+
+var (
+	rateLimiter     RateLimiter
+	rateLimiterOnce sync.Once
+)
+
+// getRateLimiter builds the backend selected by RATE_LIMIT_BACKEND on first use.
+// A Redis backend that cannot be configured falls back to memory so the
+// gateway still starts.
+func getRateLimiter() RateLimiter {
+	rateLimiterOnce.Do(func() {
+		if common.RateLimitBackend == "redis" {
+			limiter, err := newRedisLimiter(common.RedisURL)
+			if err == nil {
+				log.Printf("Rate limiter: using Redis backend")
+				rateLimiter = limiter
+				return
+			}
+			log.Printf("Failed to init Redis rate limiter, falling back to memory: %v", err)
+		}
+		rateLimiter = newMemoryLimiter()
+	})
+	return rateLimiter
+}
+
+// effectiveLimit returns the token's own limit, or the user's default when the
+// token does not set one.
+func effectiveLimit(tokenLimit int, userLimit int) int {
+	if tokenLimit > 0 {
+		return tokenLimit
+	}
+	return userLimit
+}
+
+func RateLimit() gin.HandlerFunc {
+	limiter := getRateLimiter()
 
 	return func(c *gin.Context) {
 		tokenRaw, exists := c.Get("token")
@@ -54,47 +234,116 @@ func RateLimit() gin.HandlerFunc {
 			return
 		}
 		token := tokenRaw.(*model.Token)
-		if token.RateLimitRPM <= 0 {
-			c.Next()
-			return
+
+		rpm := token.RateLimitRPM
+		tpm := token.RateLimitTPM
+		concurrency := token.MaxConcurrency
+		if userRaw, exists := c.Get("proxy_user"); exists {
+			user := userRaw.(*model.User)
+			tpm = effectiveLimit(token.RateLimitTPM, user.RateLimitTPM)
+			concurrency = effectiveLimit(token.MaxConcurrency, user.MaxConcurrency)
 		}
 
-		w := getWindow(token.ID)
-		w.mu.Lock()
+		ctx := c.Request.Context()
+		id := strconv.FormatUint(uint64(token.ID), 10)
 
-		now := time.Now()
-		windowStart := now.Add(-time.Minute)
+		if concurrency > 0 {
+			key := "concurrency:" + id
+			slot, acquired, err := limiter.Acquire(ctx, key, concurrency)
+			if err != nil {
+				// Fail open: a limiter outage should not take the gateway down
+				log.Printf("Rate limiter error: %v", err)
+			} else if !acquired {
+				rejectRateLimited(c, "concurrency", time.Second, fmt.Sprintf("Too many concurrent requests (limit %d). Please try again later.", concurrency))
+				return
+			} else {
+				stop := keepSlot(limiter, key, slot)
+				defer func() {
+					stop()
+					limiter.Release(context.Background(), key, slot)
+				}()
+			}
+		}
 
-		valid := make([]time.Time, 0, len(w.timestamps))
-		for _, ts := range w.timestamps {
-			if ts.After(windowStart) {
-				valid = append(valid, ts)
+		if tpm > 0 {
+			used, reset, err := limiter.Usage(ctx, "tpm:"+id, time.Minute)
+			if err != nil {
+				log.Printf("Rate limiter error: %v", err)
+			} else {
+				c.Header("x-ratelimit-limit-tokens", strconv.Itoa(tpm))
+				c.Header("x-ratelimit-remaining-tokens", strconv.Itoa(max(tpm-used, 0)))
+				c.Header("x-ratelimit-reset-tokens", formatReset(reset))
+				if used >= tpm {
+					rejectRateLimited(c, "tpm", reset, fmt.Sprintf("Tokens per minute limit exceeded (limit %d). Please try again later.", tpm))
+					return
+				}
 			}
 		}
-		w.timestamps = valid
 
-		if len(w.timestamps) >= token.RateLimitRPM {
-			w.mu.Unlock()
-			utils.SendOpenAIError(c, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit exceeded. Please try again later.")
-			c.Abort()
-			return
+		if rpm > 0 {
+			result, err := limiter.Allow(ctx, "rpm:"+id, rpm, time.Minute)
+			if err != nil {
+				log.Printf("Rate limiter error: %v", err)
+			} else {
+				c.Header("x-ratelimit-limit-requests", strconv.Itoa(rpm))
+				c.Header("x-ratelimit-remaining-requests", strconv.Itoa(result.Remaining))
+				c.Header("x-ratelimit-reset-requests", formatReset(result.Reset))
+				if !result.Allowed {
+					rejectRateLimited(c, "rpm", result.Reset, "Rate limit exceeded. Please try again later.")
+					return
+				}
+			}
 		}
 
-		w.timestamps = append(w.timestamps, now)
-		w.mu.Unlock()
 		c.Next()
+
+		// The proxy reports token usage once the response (including streams) is done
+		if tpm > 0 {
+			if tokens := c.GetInt("usage_total_tokens"); tokens > 0 {
+				if err := limiter.AddUsage(context.Background(), "tpm:"+id, tokens, time.Minute); err != nil {
+					log.Printf("Rate limiter error: %v", err)
+				}
+			}
+		}
 	}
 }
 
-func cleanupWindows() {
-	rlMutex.Lock()
-	defer rlMutex.Unlock()
-	now := time.Now()
-	for id, w := range rateLimitWindows {
-		w.mu.Lock()
-		if len(w.timestamps) == 0 || w.timestamps[len(w.timestamps)-1].Before(now.Add(-2*time.Minute)) {
-			delete(rateLimitWindows, id)
+// keepSlot refreshes a concurrency slot until the returned function is called,
+// so long streams keep their slot while slots of crashed instances expire.
+func keepSlot(limiter RateLimiter, key string, slot string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(concurrencySlotRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := limiter.Refresh(context.Background(), key, slot); err != nil {
+					log.Printf("Rate limiter error: %v", err)
+				}
+			}
 		}
-		w.mu.Unlock()
+	}()
+	return func() { close(done) }
+}
+
+func rejectRateLimited(c *gin.Context, reason string, retryAfter time.Duration, message string) {
+	metrics.Rejections.WithLabelValues("rate_limit", reason).Inc()
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	utils.SendOpenAIError(c, http.StatusTooManyRequests, "rate_limit_exceeded", message)
+	c.Abort()
+}
+
+// formatReset renders a reset duration the way OpenAI does, e.g. "1s" or "6m0s".
+func formatReset(d time.Duration) string {
+	if d < 0 {
+		d = 0
 	}
+	return d.Round(time.Second).String()
 }
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The scripts below keep each window in a sorted set scored by the hit time in
+// milliseconds. They use the server clock so replicas with skewed clocks still
+// share one window, and return the time until the oldest entry expires.
+
+// slidingWindowScript atomically trims the window, rejects when it is full and
+// otherwise records the new hit. Returns {allowed, remaining, reset_ms}.
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local member = ARGV[3]
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', key, now, member)
+  redis.call('PEXPIRE', key, window)
+  count = count + 1
+  allowed = 1
+end
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+// addUsageScript records amount units; the amount is the suffix of the member.
+var addUsageScript = redis.NewScript(`
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local member = ARGV[2]
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+redis.call('ZADD', key, now, member)
+redis.call('PEXPIRE', key, window)
+return 1
+`)
+
+// usageScript sums the amounts recorded within the window. Returns {total, reset_ms}.
+var usageScript = redis.NewScript(`
+local key = KEYS[1]
+local window = tonumber(ARGV[1])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local members = redis.call('ZRANGE', key, 0, -1, 'WITHSCORES')
+local total = 0
+local reset = 0
+for i = 1, #members, 2 do
+  total = total + tonumber(string.match(members[i], ':(%d+)$'))
+  if i == 1 then
+    reset = tonumber(members[i + 1]) + window - now
+  end
+end
+return {total, reset}
+`)
+
+// acquireScript takes a concurrency slot. Each request holds its own member
+// scored by when it was taken or last refreshed; members not refreshed within
+// the TTL belong to crashed instances and are evicted, so leaked slots free
+// themselves without extending the lifetime of live ones. Returns 1 if taken.
+var acquireScript = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local member = ARGV[3]
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - ttl)
+if redis.call('ZCARD', key) >= limit then
+  return 0
+end
+redis.call('ZADD', key, now, member)
+redis.call('PEXPIRE', key, ttl)
+return 1
+`)
+
+// refreshScript renews the score of a slot that is still held. Returns 0 when
+// the slot was already evicted.
+var refreshScript = redis.NewScript(`
+local key = KEYS[1]
+local ttl = tonumber(ARGV[1])
+local member = ARGV[2]
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+if not redis.call('ZSCORE', key, member) then
+  return 0
+end
+redis.call('ZADD', key, now, member)
+redis.call('PEXPIRE', key, ttl)
+return 1
+`)
+
+const (
+	// concurrencySlotTTL is how long a slot survives without a refresh.
+	concurrencySlotTTL = 2 * time.Minute
+	// concurrencySlotRefresh is how often a running request refreshes its slot.
+	concurrencySlotRefresh = 30 * time.Second
+)
+
+// redisLimiter shares limits between instances through any Redis-compatible server.
+type redisLimiter struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisLimiter(redisURL string) (*redisLimiter, error) {
+	if redisURL == "" {
+		return nil, fmt.Errorf("REDIS_URL is not set")
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ping redis: %w", err)
+	}
+
+	return &redisLimiter{client: client, prefix: "cpa:ratelimit:"}, nil
+}
+
+func uniqueMember(amount int) string {
+	return fmt.Sprintf("%d-%d:%d", time.Now().UnixNano(), rand.Uint32(), amount)
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (LimitResult, error) {
+	values, err := slidingWindowScript.Run(ctx, l.client, []string{l.prefix + key},
+		window.Milliseconds(), limit, uniqueMember(1)).Int64Slice()
+	if err != nil {
+		return LimitResult{}, err
+	}
+	return LimitResult{
+		Allowed:   values[0] == 1,
+		Remaining: int(values[1]),
+		Reset:     time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+func (l *redisLimiter) AddUsage(ctx context.Context, key string, amount int, window time.Duration) error {
+	return addUsageScript.Run(ctx, l.client, []string{l.prefix + key},
+		window.Milliseconds(), uniqueMember(amount)).Err()
+}
+
+func (l *redisLimiter) Usage(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	values, err := usageScript.Run(ctx, l.client, []string{l.prefix + key},
+		window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(values[0]), time.Duration(values[1]) * time.Millisecond, nil
+}
+
+func (l *redisLimiter) Acquire(ctx context.Context, key string, limit int) (string, bool, error) {
+	slot := uniqueMember(1)
+	result, err := acquireScript.Run(ctx, l.client, []string{l.prefix + key},
+		limit, concurrencySlotTTL.Milliseconds(), slot).Int()
+	if err != nil {
+		return "", false, err
+	}
+	return slot, result == 1, nil
+}
+
+func (l *redisLimiter) Refresh(ctx context.Context, key string, slot string) error {
+	return refreshScript.Run(ctx, l.client, []string{l.prefix + key},
+		concurrencySlotTTL.Milliseconds(), slot).Err()
+}
+
+func (l *redisLimiter) Release(ctx context.Context, key string, slot string) error {
+	return l.client.ZRem(ctx, l.prefix+key, slot).Err()
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisLimiter starts a miniredis server with a fixed clock. The
+// returned advance function moves both the clock seen by the scripts (TIME)
+// and key expiry forward.
+func newTestRedisLimiter(t *testing.T) (*redisLimiter, *miniredis.Miniredis, func(time.Duration)) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.SetTime(now)
+
+	limiter, err := newRedisLimiter("redis://" + m.Addr())
+	if err != nil {
+		t.Fatalf("newRedisLimiter: %v", err)
+	}
+	t.Cleanup(func() { limiter.client.Close() })
+
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		m.SetTime(now)
+		m.FastForward(d)
+	}
+	return limiter, m, advance
+}
+
+func TestRedisLimiterAcquireRelease(t *testing.T) {
+	limiter, _, _ := newTestRedisLimiter(t)
+	ctx := context.Background()
+
+	first, ok, err := limiter.Acquire(ctx, "concurrency:1", 2)
+	if err != nil || !ok {
+		t.Fatalf("first acquire = %v, %v; want ok", ok, err)
+	}
+	if _, ok, err := limiter.Acquire(ctx, "concurrency:1", 2); err != nil || !ok {
+		t.Fatalf("second acquire = %v, %v; want ok", ok, err)
+	}
+	if _, ok, err := limiter.Acquire(ctx, "concurrency:1", 2); err != nil || ok {
+		t.Fatalf("third acquire = %v, %v; want rejected", ok, err)
+	}
+	if _, ok, _ := limiter.Acquire(ctx, "concurrency:2", 2); !ok {
+		t.Fatal("acquire on another key was rejected")
+	}
+
+	// Releasing a slot that is not held must not free someone else's
+	if err := limiter.Release(ctx, "concurrency:1", "unknown"); err != nil {
+		t.Fatalf("release unknown slot: %v", err)
+	}
+	if _, ok, _ := limiter.Acquire(ctx, "concurrency:1", 2); ok {
+		t.Fatal("acquire succeeded after releasing an unknown slot")
+	}
+
+	if err := limiter.Release(ctx, "concurrency:1", first); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, ok, err := limiter.Acquire(ctx, "concurrency:1", 2); err != nil || !ok {
+		t.Fatalf("acquire after release = %v, %v; want ok", ok, err)
+	}
+}
+
+func TestRedisLimiterSlotTTL(t *testing.T) {
+	limiter, m, advance := newTestRedisLimiter(t)
+	ctx := context.Background()
+
+	if _, ok, _ := limiter.Acquire(ctx, "concurrency:1", 1); !ok {
+		t.Fatal("acquire was rejected")
+	}
+	if ttl := m.TTL(limiter.prefix + "concurrency:1"); ttl <= 0 || ttl > concurrencySlotTTL {
+		t.Fatalf("key TTL = %s; want within (0, %s]", ttl, concurrencySlotTTL)
+	}
+
+	// A slot that is not refreshed is evicted once the TTL has passed
+	advance(concurrencySlotTTL + time.Second)
+	held, ok, _ := limiter.Acquire(ctx, "concurrency:1", 1)
+	if !ok {
+		t.Fatal("stale slot was not evicted")
+	}
+
+	// A refreshed slot survives past the TTL of its original acquire
+	advance(concurrencySlotTTL - 10*time.Second)
+	if err := limiter.Refresh(ctx, "concurrency:1", held); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	advance(20 * time.Second)
+	if _, ok, _ := limiter.Acquire(ctx, "concurrency:1", 1); ok {
+		t.Fatal("refreshed slot was evicted")
+	}
+
+	// Acquires by other requests do not extend the held slot
+	advance(concurrencySlotTTL + time.Second)
+	if _, ok, _ := limiter.Acquire(ctx, "concurrency:1", 1); !ok {
+		t.Fatal("slot outlived its TTL")
+	}
+}
+
+func TestRedisLimiterRPMWindow(t *testing.T) {
+	limiter, _, advance := newTestRedisLimiter(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "rpm:1", 3, time.Minute)
+		if err != nil || !result.Allowed {
+			t.Fatalf("hit %d = %+v, %v; want allowed", i+1, result, err)
+		}
+		if result.Remaining != 2-i {
+			t.Fatalf("hit %d remaining = %d; want %d", i+1, result.Remaining, 2-i)
+		}
+		advance(10 * time.Second)
+	}
+
+	result, err := limiter.Allow(ctx, "rpm:1", 3, time.Minute)
+	if err != nil || result.Allowed {
+		t.Fatalf("fourth hit = %+v, %v; want rejected", result, err)
+	}
+	// The first hit was 30s ago and leaves the window in another 30s
+	if result.Reset != 30*time.Second {
+		t.Fatalf("reset = %s; want 30s", result.Reset)
+	}
+
+	advance(31 * time.Second)
+	result, err = limiter.Allow(ctx, "rpm:1", 3, time.Minute)
+	if err != nil || !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("hit after the window slid = %+v, %v; want allowed with 0 remaining", result, err)
+	}
+}
@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"cpa-distribution/common/utils"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,3 +16,49 @@ func RequestLogger() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// AccessLogger is gin's request logger with API keys passed in the query string
+// (Gemini-style ?key=) masked, so they never reach stdout.
+func AccessLogger() gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Formatter: accessLogFormatter,
+	})
+}
+
+// accessLogFormatter matches gin's default log line.
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactQuery(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// redactQuery masks the value of every key parameter in the query of path,
+// leaving the rest untouched.
+func redactQuery(path string) string {
+	idx := strings.IndexByte(path, '?')
+	if idx < 0 {
+		return path
+	}
+	params := strings.Split(path[idx+1:], "&")
+	for i, p := range params {
+		if name, _, ok := strings.Cut(p, "="); ok && name == "key" {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return path[:idx+1] + strings.Join(params, "&")
+}
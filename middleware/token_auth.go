@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"cpa-distribution/common"
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
 	"net/http"
@@ -13,56 +14,52 @@ import (
 
 func TokenAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
-			utils.SendOpenAIError(c, http.StatusUnauthorized, "invalid_api_key", "Missing or invalid API key")
-			c.Abort()
+		key := extractAPIKey(c)
+		if key == "" {
+			rejectToken(c, http.StatusUnauthorized, "invalid_api_key", "Missing or invalid API key")
 			return
 		}
 
-		key := strings.TrimPrefix(auth, "Bearer ")
 		if !strings.HasPrefix(key, common.KeyPrefix) {
-			utils.SendOpenAIError(c, http.StatusUnauthorized, "invalid_api_key", "Invalid API key format")
-			c.Abort()
+			rejectToken(c, http.StatusUnauthorized, "invalid_api_key", "Invalid API key format")
 			return
 		}
 
 		keyHash := utils.HashKey(key)
-		token, err := model.GetTokenByHash(keyHash)
+		token, user, err := model.GetAuthByKeyHash(keyHash)
 		if err != nil {
-			utils.SendOpenAIError(c, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
-			c.Abort()
+			rejectToken(c, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
 			return
 		}
 
 		if token.Status != common.StatusEnabled {
-			utils.SendOpenAIError(c, http.StatusForbidden, "token_disabled", "API key is disabled")
-			c.Abort()
+			rejectToken(c, http.StatusForbidden, "token_disabled", "API key is disabled")
 			return
 		}
 
 		if token.ExpiresAt != nil && *token.ExpiresAt > 0 && time.Unix(*token.ExpiresAt, 0).Before(time.Now()) {
-			utils.SendOpenAIError(c, http.StatusForbidden, "token_expired", "API key has expired")
-			c.Abort()
+			rejectToken(c, http.StatusForbidden, "token_expired", "API key has expired")
 			return
 		}
 
+		quotaMode := model.GetQuotaMode()
 		if token.QuotaTotal >= 0 && token.QuotaUsed >= token.QuotaTotal {
-			utils.SendOpenAIError(c, http.StatusTooManyRequests, "quota_exceeded", "API key quota exceeded")
-			c.Abort()
+			rejectToken(c, http.StatusTooManyRequests, "quota_exceeded", quotaExceededMessage("API key", quotaMode, token.QuotaResetAt))
 			return
 		}
 
-		user, err := model.GetUserByID(token.UserID)
-		if err != nil || user.Status != common.StatusEnabled {
-			utils.SendOpenAIError(c, http.StatusForbidden, "user_disabled", "User account is disabled")
-			c.Abort()
+		if user == nil || user.Status != common.StatusEnabled {
+			rejectToken(c, http.StatusForbidden, "user_disabled", "User account is disabled")
 			return
 		}
 
 		if user.QuotaTotal >= 0 && user.QuotaUsed >= user.QuotaTotal {
-			utils.SendOpenAIError(c, http.StatusTooManyRequests, "quota_exceeded", "User quota exceeded")
-			c.Abort()
+			rejectToken(c, http.StatusTooManyRequests, "quota_exceeded", quotaExceededMessage("User", quotaMode, user.QuotaResetAt))
+			return
+		}
+
+		if model.IsBillingEnabled() && user.Balance <= 0 {
+			rejectToken(c, http.StatusPaymentRequired, "insufficient_balance", "Insufficient balance")
 			return
 		}
 
@@ -77,8 +74,7 @@ func TokenAuth() gin.HandlerFunc {
 				}
 			}
 			if !allowed {
-				utils.SendOpenAIError(c, http.StatusForbidden, "ip_not_allowed", "IP not in allowlist")
-				c.Abort()
+				rejectToken(c, http.StatusForbidden, "ip_not_allowed", "IP not in allowlist")
 				return
 			}
 		}
@@ -95,3 +91,37 @@ func TokenAuth() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// rejectToken aborts with an OpenAI-style error and counts the rejection.
+func rejectToken(c *gin.Context, status int, code string, message string) {
+	metrics.Rejections.WithLabelValues("token_auth", code).Inc()
+	utils.SendOpenAIError(c, status, code, message)
+	c.Abort()
+}
+
+// extractAPIKey reads the API key from "Authorization: Bearer" (OpenAI style),
+// the x-api-key header (Anthropic style), or the x-goog-api-key header and the
+// key query parameter (Gemini style).
+func extractAPIKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := c.GetHeader("x-api-key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	if key := c.GetHeader("x-goog-api-key"); key != "" {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(c.Query("key"))
+}
+
+func quotaExceededMessage(subject string, quotaMode string, resetAt *int64) string {
+	message := subject + " request quota exceeded"
+	if quotaMode == common.QuotaModeToken {
+		message = subject + " token quota exceeded"
+	}
+	if resetAt != nil && *resetAt > 0 {
+		message += ", resets at " + time.Unix(*resetAt, 0).UTC().Format(time.RFC3339)
+	}
+	return message
+}
@@ -0,0 +1,345 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	GranularityHour  = "hour"
+	GranularityDay   = "day"
+	GranularityMonth = "month"
+)
+
+// Dimensions analytics can be grouped by.
+const (
+	GroupByModel       = "model"
+	GroupByUser        = "user"
+	GroupByToken       = "token"
+	GroupByStatusClass = "status_class"
+	GroupByIP          = "ip"
+)
+
+// AnalyticsQuery selects the logs in [Start, End), optionally of one user,
+// and how they are bucketed and grouped. Only the Limit largest groups are
+// returned; the rest are merged into an "other" series. Percentiles are only
+// computed when requested, as they need a second pass over the logs.
+type AnalyticsQuery struct {
+	Start       time.Time
+	End         time.Time
+	Granularity string
+	GroupBy     string
+	UserID      uint
+	Limit       int
+	Percentiles bool
+}
+
+// AnalyticsPoint holds the metrics of one time bucket. Latencies are in
+// milliseconds and the error rate is the share of failed requests (see
+// RequestLog.IsError).
+type AnalyticsPoint struct {
+	Time       string  `json:"time"`
+	Requests   int64   `json:"requests"`
+	Tokens     int64   `json:"tokens"`
+	ErrorRate  float64 `json:"error_rate"`
+	P50Latency int     `json:"p50_latency"`
+	P95Latency int     `json:"p95_latency"`
+}
+
+// AnalyticsSeries is the time series of one group, with a point per bucket.
+type AnalyticsSeries struct {
+	Key    string           `json:"key"`
+	Points []AnalyticsPoint `json:"points"`
+}
+
+// analyticsSampleLimit bounds how many durations are loaded for percentiles.
+// Larger ranges are sampled by log ID.
+const analyticsSampleLimit = 50000
+
+type analyticsCell struct {
+	requests    int64
+	tokens      int64
+	errors      int64
+	durationSum int64
+	durations   []int
+}
+
+func (c *analyticsCell) add(o analyticsCell) {
+	c.requests += o.requests
+	c.tokens += o.tokens
+	c.errors += o.errors
+	c.durationSum += o.durationSum
+}
+
+// AnalyticsBuckets returns the labels of the buckets covering [start, end).
+func AnalyticsBuckets(start, end time.Time, granularity string) []string {
+	var buckets []string
+	for t := truncateBucket(start, granularity); t.Before(end); t = nextBucket(t, granularity) {
+		buckets = append(buckets, bucketLabel(t, granularity))
+	}
+	return buckets
+}
+
+func truncateBucket(t time.Time, granularity string) time.Time {
+	t = t.Local()
+	switch granularity {
+	case GranularityHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case GranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func nextBucket(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case GranularityHour:
+		return t.Add(time.Hour)
+	case GranularityMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func bucketLabel(t time.Time, granularity string) string {
+	t = t.Local()
+	switch granularity {
+	case GranularityHour:
+		return t.Format("2006-01-02 15:00")
+	case GranularityMonth:
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// analyticsKeyColumn is the SQL expression a dimension groups by.
+func analyticsKeyColumn(groupBy string) string {
+	switch groupBy {
+	case GroupByModel:
+		return "model"
+	case GroupByUser:
+		return "user_id"
+	case GroupByToken:
+		return "token_id"
+	case GroupByStatusClass:
+		return "status_code / 100"
+	case GroupByIP:
+		return "request_ip"
+	}
+	return "'all'"
+}
+
+// analyticsKeyLabel formats a value of analyticsKeyColumn as a series key.
+func analyticsKeyLabel(value string, groupBy string) string {
+	if groupBy == GroupByStatusClass {
+		return value + "xx"
+	}
+	return value
+}
+
+// epochColumn is the SQL expression for created_at in Unix seconds.
+func epochColumn() string {
+	if DB.Dialector.Name() == "postgres" {
+		return "CAST(EXTRACT(EPOCH FROM created_at) AS BIGINT)"
+	}
+	return "CAST(strftime('%s', created_at) AS INTEGER)"
+}
+
+// analyticsSegment is a part of the range with one UTC offset, so buckets can
+// be computed in SQL by integer division of the shifted Unix time.
+type analyticsSegment struct {
+	start, end time.Time
+	offset     int64
+}
+
+// analyticsSegments splits [start, end) at the local time zone's transitions.
+func analyticsSegments(start, end time.Time) []analyticsSegment {
+	var segments []analyticsSegment
+	for segStart := start; segStart.Before(end); {
+		local := segStart.Local()
+		_, offset := local.Zone()
+		segEnd := end
+		if _, zoneEnd := local.ZoneBounds(); !zoneEnd.IsZero() && zoneEnd.Before(end) {
+			segEnd = zoneEnd
+		}
+		segments = append(segments, analyticsSegment{segStart, segEnd, int64(offset)})
+		segStart = segEnd
+	}
+	return segments
+}
+
+// analyticsUnit is the bucket size used in SQL. Months are not a fixed length,
+// so they are built from days.
+func analyticsUnit(granularity string) int64 {
+	if granularity == GranularityHour {
+		return 3600
+	}
+	return 86400
+}
+
+// GetAnalytics aggregates request logs into time series. Counts are grouped in
+// the database; percentile latencies come from at most analyticsSampleLimit
+// logs, and buckets without a sampled log report their mean instead.
+func GetAnalytics(q AnalyticsQuery) ([]AnalyticsSeries, error) {
+	base := func(start, end time.Time) *gorm.DB {
+		query := DB.Model(&RequestLog{}).Where("created_at >= ? AND created_at < ?", start, end)
+		if q.UserID > 0 {
+			query = query.Where("user_id = ?", q.UserID)
+		}
+		return query
+	}
+	keyColumn := analyticsKeyColumn(q.GroupBy)
+
+	// Find the largest groups first so the bucket query returns a bounded
+	// number of rows; the others are folded into "other" by the database
+	var top []struct {
+		GroupKey string
+	}
+	topQuery := base(q.Start, q.End).Select(keyColumn + " AS group_key").
+		Group("group_key").Order("COUNT(*) DESC").Order("group_key")
+	if q.Limit > 0 {
+		topQuery = topQuery.Limit(q.Limit + 1)
+	}
+	if err := topQuery.Scan(&top).Error; err != nil {
+		return nil, err
+	}
+	if len(top) == 0 {
+		return []AnalyticsSeries{}, nil
+	}
+	groupColumn := keyColumn
+	var groupArgs []interface{}
+	if q.Limit > 0 && len(top) > q.Limit {
+		keys := make([]string, q.Limit)
+		for i := range keys {
+			keys[i] = top[i].GroupKey
+		}
+		groupColumn = "CASE WHEN CAST(" + keyColumn + " AS TEXT) IN ? THEN CAST(" + keyColumn + " AS TEXT) END"
+		groupArgs = []interface{}{keys}
+	}
+
+	unit := analyticsUnit(q.Granularity)
+	segments := analyticsSegments(q.Start, q.End)
+	groups := make(map[string]map[string]*analyticsCell)
+	cellOf := func(key *string, bucket int64, offset int64) *analyticsCell {
+		label := "other"
+		if key != nil {
+			label = analyticsKeyLabel(*key, q.GroupBy)
+		}
+		cells, exists := groups[label]
+		if !exists {
+			cells = make(map[string]*analyticsCell)
+			groups[label] = cells
+		}
+		bucketTime := bucketLabel(time.Unix(bucket*unit-offset, 0), q.Granularity)
+		cell, exists := cells[bucketTime]
+		if !exists {
+			cell = &analyticsCell{}
+			cells[bucketTime] = cell
+		}
+		return cell
+	}
+
+	var total int64
+	for _, seg := range segments {
+		bucketColumn := fmt.Sprintf("(%s + %d) / %d", epochColumn(), seg.offset, unit)
+		var rows []struct {
+			GroupKey    *string
+			Bucket      int64
+			Requests    int64
+			Tokens      int64
+			Errors      int64
+			DurationSum int64
+		}
+		err := base(seg.start, seg.end).
+			Select(groupColumn+" AS group_key, "+bucketColumn+" AS bucket, COUNT(*) AS requests, "+
+				"COALESCE(SUM(total_tokens), 0) AS tokens, "+
+				"SUM(CASE WHEN "+errorCondition+" THEN 1 ELSE 0 END) AS errors, "+
+				"COALESCE(SUM(duration), 0) AS duration_sum", groupArgs...).
+			Group("group_key, bucket").
+			Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			cellOf(row.GroupKey, row.Bucket, seg.offset).add(analyticsCell{
+				requests:    row.Requests,
+				tokens:      row.Tokens,
+				errors:      row.Errors,
+				durationSum: row.DurationSum,
+			})
+			total += row.Requests
+		}
+	}
+
+	if q.Percentiles {
+		stride := (total + analyticsSampleLimit - 1) / analyticsSampleLimit
+		for _, seg := range segments {
+			bucketColumn := fmt.Sprintf("(%s + %d) / %d", epochColumn(), seg.offset, unit)
+			query := base(seg.start, seg.end).Select(groupColumn+" AS group_key, "+bucketColumn+" AS bucket, duration", groupArgs...)
+			if stride > 1 {
+				query = query.Where("id % ? = 0", stride)
+			}
+			var samples []struct {
+				GroupKey *string
+				Bucket   int64
+				Duration int
+			}
+			if err := query.Limit(analyticsSampleLimit).Scan(&samples).Error; err != nil {
+				return nil, err
+			}
+			for _, sample := range samples {
+				cell := cellOf(sample.GroupKey, sample.Bucket, seg.offset)
+				cell.durations = append(cell.durations, sample.Duration)
+			}
+		}
+	}
+
+	totals := make(map[string]int64, len(groups))
+	keys := make([]string, 0, len(groups))
+	for key, cells := range groups {
+		for _, cell := range cells {
+			totals[key] += cell.requests
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// "other" always comes last
+		if (keys[i] == "other") != (keys[j] == "other") {
+			return keys[j] == "other"
+		}
+		if totals[keys[i]] != totals[keys[j]] {
+			return totals[keys[i]] > totals[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	buckets := AnalyticsBuckets(q.Start, q.End, q.Granularity)
+	series := make([]AnalyticsSeries, 0, len(keys))
+	for _, key := range keys {
+		s := AnalyticsSeries{Key: key, Points: make([]AnalyticsPoint, 0, len(buckets))}
+		for _, bucket := range buckets {
+			point := AnalyticsPoint{Time: bucket}
+			if cell := groups[key][bucket]; cell != nil && cell.requests > 0 {
+				point.Requests = cell.requests
+				point.Tokens = cell.tokens
+				point.ErrorRate = float64(cell.errors) / float64(cell.requests)
+				if q.Percentiles {
+					if len(cell.durations) > 0 {
+						sort.Ints(cell.durations)
+						point.P50Latency = percentile(cell.durations, 50)
+						point.P95Latency = percentile(cell.durations, 95)
+					} else {
+						mean := int(cell.durationSum / cell.requests)
+						point.P50Latency, point.P95Latency = mean, mean
+					}
+				}
+			}
+			s.Points = append(s.Points, point)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
@@ -0,0 +1,228 @@
+package model
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	authCacheSize = 10000
+	authCacheTTL  = 60 * time.Second
+)
+
+// UsageDelta is a usage increment that has not been written to the database yet.
+type UsageDelta struct {
+	Quota    int64
+	Requests int64
+	Cost     float64
+}
+
+type authCacheEntry struct {
+	keyHash   string
+	token     Token
+	user      User
+	expiresAt time.Time
+}
+
+// authCache is an LRU cache of token and user records keyed by key hash, so
+// proxied requests can skip the two lookups TokenAuth needs. It also tracks
+// usage that is still waiting to be written, so records loaded from the
+// database include it.
+type authCache struct {
+	entries       map[string]*list.Element
+	byToken       map[uint]string
+	byUser        map[uint]map[string]struct{}
+	lru           *list.List
+	pendingTokens map[uint]*UsageDelta
+	pendingUsers  map[uint]*UsageDelta
+	settleGen     uint64
+	mu            sync.Mutex
+}
+
+var tokenAuthCache = &authCache{
+	entries:       make(map[string]*list.Element),
+	byToken:       make(map[uint]string),
+	byUser:        make(map[uint]map[string]struct{}),
+	lru:           list.New(),
+	pendingTokens: make(map[uint]*UsageDelta),
+	pendingUsers:  make(map[uint]*UsageDelta),
+}
+
+// GetAuthByKeyHash returns copies of the enabled token with the given key hash
+// and its owner. The user is nil when it cannot be loaded.
+func GetAuthByKeyHash(hash string) (*Token, *User, error) {
+	if token, user, ok := tokenAuthCache.get(hash); ok {
+		return token, user, nil
+	}
+
+	gen := tokenAuthCache.generation()
+	token, err := GetTokenByHash(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := GetUserByID(token.UserID)
+	if err != nil {
+		return token, nil, nil
+	}
+
+	tokenAuthCache.put(hash, token, user, gen)
+	return token, user, nil
+}
+
+// InvalidateTokenCache drops the cached entry of a token after it changes.
+func InvalidateTokenCache(tokenID uint) {
+	tokenAuthCache.mu.Lock()
+	defer tokenAuthCache.mu.Unlock()
+	if hash, exists := tokenAuthCache.byToken[tokenID]; exists {
+		tokenAuthCache.removeLocked(hash)
+	}
+}
+
+// InvalidateUserCache drops the cached entries of all tokens owned by a user.
+func InvalidateUserCache(userID uint) {
+	tokenAuthCache.mu.Lock()
+	defer tokenAuthCache.mu.Unlock()
+	for hash := range tokenAuthCache.byUser[userID] {
+		tokenAuthCache.removeLocked(hash)
+	}
+}
+
+// AddPendingUsage records a usage increment that is about to be queued for the
+// database and applies it to cached records, so quota checks stay accurate
+// before the increment is written.
+func AddPendingUsage(tokenID uint, userID uint, quota int64, cost float64) {
+	tokenAuthCache.mu.Lock()
+	defer tokenAuthCache.mu.Unlock()
+	addDelta(tokenAuthCache.pendingTokens, tokenID, quota, 1, 0)
+	addDelta(tokenAuthCache.pendingUsers, userID, quota, 0, cost)
+	if hash, exists := tokenAuthCache.byToken[tokenID]; exists {
+		entry := tokenAuthCache.entries[hash].Value.(*authCacheEntry)
+		entry.token.QuotaUsed += quota
+		entry.token.TotalRequests++
+	}
+	for hash := range tokenAuthCache.byUser[userID] {
+		entry := tokenAuthCache.entries[hash].Value.(*authCacheEntry)
+		entry.user.QuotaUsed += quota
+		entry.user.Balance -= cost
+	}
+}
+
+// BeginUsageSettle must be called before pending usage is written, so records
+// read from the database while the write is in flight are not cached.
+func BeginUsageSettle() {
+	tokenAuthCache.mu.Lock()
+	tokenAuthCache.settleGen++
+	tokenAuthCache.mu.Unlock()
+}
+
+// SettlePendingUsage removes increments that have been written to the database
+// from the pending usage.
+func SettlePendingUsage(tokens map[uint]*UsageDelta, users map[uint]*UsageDelta) {
+	tokenAuthCache.mu.Lock()
+	defer tokenAuthCache.mu.Unlock()
+	tokenAuthCache.settleGen++
+	for id, d := range tokens {
+		addDelta(tokenAuthCache.pendingTokens, id, -d.Quota, -d.Requests, -d.Cost)
+	}
+	for id, d := range users {
+		addDelta(tokenAuthCache.pendingUsers, id, -d.Quota, -d.Requests, -d.Cost)
+	}
+}
+
+func addDelta(deltas map[uint]*UsageDelta, id uint, quota int64, requests int64, cost float64) {
+	d, exists := deltas[id]
+	if !exists {
+		d = &UsageDelta{}
+		deltas[id] = d
+	}
+	d.Quota += quota
+	d.Requests += requests
+	d.Cost += cost
+	if d.Quota == 0 && d.Requests == 0 && d.Cost == 0 {
+		delete(deltas, id)
+	}
+}
+
+func (ac *authCache) generation() uint64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.settleGen
+}
+
+func (ac *authCache) get(hash string) (*Token, *User, bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	elem, exists := ac.entries[hash]
+	if !exists {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*authCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		ac.removeLocked(hash)
+		return nil, nil, false
+	}
+
+	ac.lru.MoveToFront(elem)
+	token := entry.token
+	user := entry.user
+	return &token, &user, true
+}
+
+// put applies pending usage to records loaded from the database and caches
+// them, unless pending usage was settled since gen was taken.
+func (ac *authCache) put(hash string, token *Token, user *User, gen uint64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if d, exists := ac.pendingTokens[token.ID]; exists {
+		token.QuotaUsed += d.Quota
+		token.TotalRequests += d.Requests
+	}
+	if d, exists := ac.pendingUsers[user.ID]; exists {
+		user.QuotaUsed += d.Quota
+		user.Balance -= d.Cost
+	}
+	if gen != ac.settleGen {
+		return
+	}
+
+	ac.removeLocked(hash)
+	entry := &authCacheEntry{
+		keyHash:   hash,
+		token:     *token,
+		user:      *user,
+		expiresAt: time.Now().Add(authCacheTTL),
+	}
+	ac.entries[hash] = ac.lru.PushFront(entry)
+	ac.byToken[token.ID] = hash
+	if ac.byUser[user.ID] == nil {
+		ac.byUser[user.ID] = make(map[string]struct{})
+	}
+	ac.byUser[user.ID][hash] = struct{}{}
+
+	for ac.lru.Len() > authCacheSize {
+		oldest := ac.lru.Back().Value.(*authCacheEntry)
+		ac.removeLocked(oldest.keyHash)
+	}
+}
+
+func (ac *authCache) removeLocked(hash string) {
+	elem, exists := ac.entries[hash]
+	if !exists {
+		return
+	}
+	entry := elem.Value.(*authCacheEntry)
+	ac.lru.Remove(elem)
+	delete(ac.entries, hash)
+	if ac.byToken[entry.token.ID] == hash {
+		delete(ac.byToken, entry.token.ID)
+	}
+	if hashes := ac.byUser[entry.user.ID]; hashes != nil {
+		delete(hashes, hash)
+		if len(hashes) == 0 {
+			delete(ac.byUser, entry.user.ID)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"gorm.io/gorm"
+)
+
+type Channel struct {
+	gorm.Model
+	Name     string `gorm:"size:128" json:"name"`
+	BaseURL  string `gorm:"size:512" json:"base_url"`
+	Key      string `gorm:"size:512" json:"key"`
+	Weight   int    `gorm:"default:1" json:"weight"`
+	Priority int    `gorm:"default:0" json:"priority"`
+	Status   int    `gorm:"default:1" json:"status"`
+}
+
+func GetAllChannels() ([]Channel, error) {
+	var channels []Channel
+	err := DB.Order("priority desc, id asc").Find(&channels).Error
+	return channels, err
+}
+
+func GetEnabledChannels() ([]Channel, error) {
+	var channels []Channel
+	err := DB.Where("status = 1").Order("priority desc, id asc").Find(&channels).Error
+	return channels, err
+}
+
+func GetChannelByID(id uint) (*Channel, error) {
+	var channel Channel
+	err := DB.First(&channel, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (ch *Channel) Insert() error {
+	return DB.Create(ch).Error
+}
+
+func (ch *Channel) Update() error {
+	return DB.Save(ch).Error
+}
+
+func (ch *Channel) Delete() error {
+	return DB.Delete(ch).Error
+}
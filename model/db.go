@@ -46,6 +46,14 @@ func InitDB() {
 	migrate()
 }
 
+func CloseDB() {
+	if sqlDB, err := DB.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			log.Printf("Failed to close database: %v", err)
+		}
+	}
+}
+
 func migrate() {
 	err := DB.AutoMigrate(
 		&User{},
@@ -53,6 +61,11 @@ func migrate() {
 		&RequestLog{},
 		&IPBan{},
 		&SystemSetting{},
+		&Channel{},
+		&ModelPrice{},
+		&ModelMapping{},
+		&QuotaHistory{},
+		&UsageDaily{},
 	)
 	if err != nil {
 		log.Fatal("Failed to migrate database: ", err)
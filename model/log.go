@@ -1,22 +1,42 @@
 package model
 
 import (
+	"sort"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
+)
+
+// Error types recorded for requests that failed at the gateway.
+const (
+	ErrorTypeUpstream    = "upstream_error"
+	ErrorTypeTimeout     = "timeout"
+	ErrorTypeCircuitOpen = "circuit_open"
+	ErrorTypeTooLarge    = "too_large"
 )
 
 type RequestLog struct {
 	ID               uint      `gorm:"primaryKey" json:"id"`
 	UserID           uint      `gorm:"index" json:"user_id"`
 	TokenID          uint      `gorm:"index" json:"token_id"`
+	ChannelID        uint      `gorm:"index" json:"channel_id"`
 	RequestIP        string    `gorm:"size:45;index" json:"request_ip"`
 	Method           string    `gorm:"size:10" json:"method"`
 	Path             string    `gorm:"size:512" json:"path"`
 	Model            string    `gorm:"size:64;index" json:"model"`
+	UpstreamModel    string    `gorm:"size:64" json:"upstream_model"`
 	StatusCode       int       `json:"status_code"`
+	Attempts         int       `gorm:"default:1" json:"attempts"`
+	IsStream         bool      `json:"is_stream"`
 	Duration         int       `json:"duration"`
+	FirstTokenTime   int       `json:"first_token_time"`
+	TokensPerSecond  float64   `json:"tokens_per_second"`
 	PromptTokens     int       `json:"prompt_tokens"`
 	CompletionTokens int       `json:"completion_tokens"`
 	TotalTokens      int       `json:"total_tokens"`
+	Cost             float64   `json:"cost"`
+	ErrorType        string    `gorm:"size:32" json:"error_type"`
 	ErrorMessage     string    `gorm:"size:512" json:"error_message"`
 	CreatedAt        time.Time `gorm:"index" json:"created_at"`
 }
@@ -25,77 +45,313 @@ func BatchInsertLogs(logs []RequestLog) error {
 	if len(logs) == 0 {
 		return nil
 	}
-	return DB.CreateInBatches(logs, 100).Error
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(logs, 100).Error; err != nil {
+			return err
+		}
+		return rollupLogs(tx, logs)
+	})
+}
+
+// LogFilter selects request logs. Zero fields do not filter; the time range
+// is [Start, End). StatusClass is the first digit of the status, e.g. 5 for
+// 5xx. ErrorsOnly matches statuses >= 400 and gateway errors, and
+// ErrorContains is a case-insensitive substring of the error message.
+type LogFilter struct {
+	UserID        uint
+	TokenID       uint
+	Model         string
+	IP            string
+	Start         *time.Time
+	End           *time.Time
+	StatusCode    int
+	StatusClass   int
+	PathPrefix    string
+	MinDuration   int
+	ErrorsOnly    bool
+	ErrorContains string
+}
+
+// errorCondition matches the logs IsError reports as errors.
+const errorCondition = "(status_code >= 400 OR error_type <> '')"
+
+// IsError reports whether the request failed: an error status from the
+// upstream, or a gateway error such as a timeout in the middle of a 200 stream.
+func (l *RequestLog) IsError() bool {
+	return l.StatusCode >= 400 || l.ErrorType != ""
+}
+
+func (f LogFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.UserID > 0 {
+		query = query.Where("user_id = ?", f.UserID)
+	}
+	if f.TokenID > 0 {
+		query = query.Where("token_id = ?", f.TokenID)
+	}
+	if f.Model != "" {
+		query = query.Where("model = ?", f.Model)
+	}
+	if f.IP != "" {
+		query = query.Where("request_ip = ?", f.IP)
+	}
+	if f.Start != nil {
+		query = query.Where("created_at >= ?", *f.Start)
+	}
+	if f.End != nil {
+		query = query.Where("created_at < ?", *f.End)
+	}
+	if f.StatusCode > 0 {
+		query = query.Where("status_code = ?", f.StatusCode)
+	}
+	if f.StatusClass > 0 {
+		query = query.Where("status_code >= ? AND status_code < ?", f.StatusClass*100, f.StatusClass*100+100)
+	}
+	if f.PathPrefix != "" {
+		query = query.Where(`path LIKE ? ESCAPE '\'`, escapeLike(f.PathPrefix)+"%")
+	}
+	if f.MinDuration > 0 {
+		query = query.Where("duration >= ?", f.MinDuration)
+	}
+	if f.ErrorsOnly {
+		query = query.Where(errorCondition)
+	}
+	if f.ErrorContains != "" {
+		query = query.Where(`LOWER(error_message) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(f.ErrorContains))+"%")
+	}
+	return query
 }
 
-func GetLogsByUserID(userID uint, page, pageSize int, model string) ([]RequestLog, int64, error) {
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// GetAllLogs returns a page of logs matching filter, newest first. With
+// cursor set to the id of the last log of the previous page, keyset
+// pagination is used and page and the total are ignored; otherwise page is
+// 1-based and the matching logs are counted.
+func GetAllLogs(filter LogFilter, page, pageSize int, cursor uint) ([]RequestLog, int64, error) {
 	var logs []RequestLog
 	var total int64
-	query := DB.Model(&RequestLog{}).Where("user_id = ?", userID)
-	if model != "" {
-		query = query.Where("model = ?", model)
+	query := filter.apply(DB.Model(&RequestLog{}))
+	if cursor > 0 {
+		err := query.Where("id < ?", cursor).Order("id desc").Limit(pageSize).Find(&logs).Error
+		return logs, 0, err
 	}
 	query.Count(&total)
 	err := query.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&logs).Error
 	return logs, total, err
 }
 
-func GetAllLogs(page, pageSize int, userID uint, tokenID uint, model string, ip string) ([]RequestLog, int64, error) {
-	var logs []RequestLog
-	var total int64
-	query := DB.Model(&RequestLog{})
-	if userID > 0 {
-		query = query.Where("user_id = ?", userID)
-	}
-	if tokenID > 0 {
-		query = query.Where("token_id = ?", tokenID)
+// EachLog calls fn for every log matching filter in id order, streaming rows
+// from the database instead of loading them all.
+func EachLog(filter LogFilter, fn func(*RequestLog) error) error {
+	rows, err := filter.apply(DB.Model(&RequestLog{})).Order("id").Rows()
+	if err != nil {
+		return err
 	}
-	if model != "" {
-		query = query.Where("model = ?", model)
+	defer rows.Close()
+
+	for rows.Next() {
+		var l RequestLog
+		if err := DB.ScanRows(rows, &l); err != nil {
+			return err
+		}
+		if err := fn(&l); err != nil {
+			return err
+		}
 	}
-	if ip != "" {
-		query = query.Where("request_ip = ?", ip)
+	return rows.Err()
+}
+
+// DeleteLogsChunk deletes up to limit logs created before cutoff, oldest
+// first. Their usage stays in UsageDaily.
+func DeleteLogsChunk(cutoff time.Time, limit int) (int64, error) {
+	var ids []uint
+	err := DB.Model(&RequestLog{}).Where("created_at < ?", cutoff).
+		Order("id").Limit(limit).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
 	}
-	query.Count(&total)
-	err := query.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&logs).Error
-	return logs, total, err
+	result := DB.Where("id IN ?", ids).Delete(&RequestLog{})
+	return result.RowsAffected, result.Error
 }
 
 type LogStats struct {
-	TotalRequests int64 `json:"total_requests"`
-	TotalTokens   int64 `json:"total_tokens"`
-	TodayRequests int64 `json:"today_requests"`
-	TodayTokens   int64 `json:"today_tokens"`
+	TotalRequests int64   `json:"total_requests"`
+	TotalTokens   int64   `json:"total_tokens"`
+	TotalCost     float64 `json:"total_cost"`
+	TodayRequests int64   `json:"today_requests"`
+	TodayTokens   int64   `json:"today_tokens"`
+	TodayCost     float64 `json:"today_cost"`
+	SpoolDepth    int64   `gorm:"-" json:"spool_depth,omitempty"`
 }
 
 func GetUserLogStats(userID uint) LogStats {
-	var stats LogStats
-	DB.Model(&RequestLog{}).Where("user_id = ?", userID).
-		Select("COUNT(*) as total_requests, COALESCE(SUM(total_tokens), 0) as total_tokens").
-		Scan(&stats)
-
-	today := time.Now().Truncate(24 * time.Hour)
-	DB.Model(&RequestLog{}).Where("user_id = ? AND created_at >= ?", userID, today).
-		Select("COUNT(*) as today_requests, COALESCE(SUM(total_tokens), 0) as today_tokens").
-		Scan(&stats)
-	return stats
+	return getUsageStats(func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ?", userID)
+	})
 }
 
 func GetGlobalLogStats() LogStats {
-	var stats LogStats
-	DB.Model(&RequestLog{}).
-		Select("COUNT(*) as total_requests, COALESCE(SUM(total_tokens), 0) as total_tokens").
-		Scan(&stats)
+	return getUsageStats(func(db *gorm.DB) *gorm.DB { return db })
+}
 
-	today := time.Now().Truncate(24 * time.Hour)
-	DB.Model(&RequestLog{}).Where("created_at >= ?", today).
-		Select("COUNT(*) as today_requests, COALESCE(SUM(total_tokens), 0) as today_tokens").
+// getUsageStats sums the daily rollup rows selected by scope.
+func getUsageStats(scope func(*gorm.DB) *gorm.DB) LogStats {
+	var stats, today LogStats
+	DB.Model(&UsageDaily{}).Scopes(scope).
+		Select("COALESCE(SUM(requests), 0) as total_requests, COALESCE(SUM(total_tokens), 0) as total_tokens, COALESCE(SUM(cost), 0) as total_cost").
 		Scan(&stats)
+
+	// Scan zeroes the destination, so today's totals are read separately
+	DB.Model(&UsageDaily{}).Scopes(scope).Where("date = ?", usageDate(time.Now())).
+		Select("COALESCE(SUM(requests), 0) as today_requests, COALESCE(SUM(total_tokens), 0) as today_tokens, COALESCE(SUM(cost), 0) as today_cost").
+		Scan(&today)
+	stats.TodayRequests = today.TodayRequests
+	stats.TodayTokens = today.TodayTokens
+	stats.TodayCost = today.TodayCost
 	return stats
 }
 
-func DeleteLogsBeforeDays(days int) (int64, error) {
-	cutoff := time.Now().AddDate(0, 0, -days)
-	result := DB.Where("created_at < ?", cutoff).Delete(&RequestLog{})
-	return result.RowsAffected, result.Error
+// LatencyStats summarises the streams of one model or channel. Times are in
+// milliseconds, throughput in output tokens per second.
+type LatencyStats struct {
+	Model       string  `json:"model,omitempty"`
+	ChannelID   uint    `json:"channel_id"`
+	Requests    int     `json:"requests"`
+	TTFTP50     int     `json:"ttft_p50"`
+	TTFTP95     int     `json:"ttft_p95"`
+	DurationP50 int     `json:"duration_p50"`
+	DurationP95 int     `json:"duration_p95"`
+	TPSP50      float64 `json:"tps_p50"`
+	TPSP95      float64 `json:"tps_p95"`
+}
+
+// latencySampleLimit bounds how many streams are loaded for percentiles.
+const latencySampleLimit = 50000
+
+type latencySample struct {
+	Model           string
+	ChannelID       uint
+	FirstTokenTime  int
+	Duration        int
+	TokensPerSecond float64
+}
+
+// GetStreamLatencyStats computes percentiles over successful streams since the
+// given time, grouped by model and by channel. SQLite has no percentile
+// functions, so at most latencySampleLimit streams, spread evenly by id, are
+// loaded once and sorted here; request counts are exact.
+func GetStreamLatencyStats(since time.Time) (byModel, byChannel []LatencyStats, err error) {
+	streams := func() *gorm.DB {
+		return DB.Model(&RequestLog{}).
+			Where("is_stream = ? AND status_code >= 200 AND status_code < 300 AND created_at >= ?", true, since)
+	}
+
+	var counts []struct {
+		Model     string
+		ChannelID uint
+		Requests  int
+	}
+	err = streams().Select("model, channel_id, COUNT(*) as requests").Group("model, channel_id").Scan(&counts).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	total := 0
+	for _, c := range counts {
+		total += c.Requests
+	}
+	if total == 0 {
+		return []LatencyStats{}, []LatencyStats{}, nil
+	}
+
+	query := streams().Select("model, channel_id, first_token_time, duration, tokens_per_second")
+	if stride := (total + latencySampleLimit - 1) / latencySampleLimit; stride > 1 {
+		query = query.Where("id % ? = 0", stride)
+	}
+	var samples []latencySample
+	if err := query.Limit(latencySampleLimit).Scan(&samples).Error; err != nil {
+		return nil, nil, err
+	}
+
+	models, channels := newLatencyGroups(), newLatencyGroups()
+	for _, c := range counts {
+		models.get(LatencyStats{Model: c.Model}).stats.Requests += c.Requests
+		channels.get(LatencyStats{ChannelID: c.ChannelID}).stats.Requests += c.Requests
+	}
+	for _, s := range samples {
+		models.get(LatencyStats{Model: s.Model}).add(s)
+		channels.get(LatencyStats{ChannelID: s.ChannelID}).add(s)
+	}
+	return models.result(), channels.result(), nil
+}
+
+type latencyGroup struct {
+	stats     LatencyStats
+	ttft      []int
+	durations []int
+	tps       []float64
+}
+
+func (g *latencyGroup) add(s latencySample) {
+	if s.FirstTokenTime > 0 {
+		g.ttft = append(g.ttft, s.FirstTokenTime)
+	}
+	g.durations = append(g.durations, s.Duration)
+	if s.TokensPerSecond > 0 {
+		g.tps = append(g.tps, s.TokensPerSecond)
+	}
+}
+
+type latencyGroups struct {
+	groups map[LatencyStats]*latencyGroup
+	order  []*latencyGroup
+}
+
+func newLatencyGroups() *latencyGroups {
+	return &latencyGroups{groups: make(map[LatencyStats]*latencyGroup)}
+}
+
+func (l *latencyGroups) get(key LatencyStats) *latencyGroup {
+	g, exists := l.groups[key]
+	if !exists {
+		g = &latencyGroup{stats: key}
+		l.groups[key] = g
+		l.order = append(l.order, g)
+	}
+	return g
+}
+
+// result computes the percentiles of each group, busiest first.
+func (l *latencyGroups) result() []LatencyStats {
+	result := make([]LatencyStats, 0, len(l.order))
+	for _, g := range l.order {
+		sort.Ints(g.ttft)
+		sort.Ints(g.durations)
+		sort.Float64s(g.tps)
+		g.stats.TTFTP50 = percentile(g.ttft, 50)
+		g.stats.TTFTP95 = percentile(g.ttft, 95)
+		g.stats.DurationP50 = percentile(g.durations, 50)
+		g.stats.DurationP95 = percentile(g.durations, 95)
+		g.stats.TPSP50 = percentile(g.tps, 50)
+		g.stats.TPSP95 = percentile(g.tps, 95)
+		result = append(result, g.stats)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Requests > result[j].Requests
+	})
+	return result
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile[T int | float64](sorted []T, p int) T {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
 }
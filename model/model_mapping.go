@@ -0,0 +1,43 @@
+package model
+
+import (
+	"time"
+)
+
+// ModelMapping rewrites a requested model name to the upstream identifier.
+// Pattern may contain a single "*" wildcard; a "*" in Target is replaced with
+// the part of the requested name it matched.
+type ModelMapping struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Pattern   string    `gorm:"size:64;uniqueIndex" json:"pattern"`
+	Target    string    `gorm:"size:64" json:"target"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func GetAllModelMappings() ([]ModelMapping, error) {
+	var mappings []ModelMapping
+	err := DB.Order("pattern asc").Find(&mappings).Error
+	return mappings, err
+}
+
+func GetModelMappingByID(id uint) (*ModelMapping, error) {
+	var mapping ModelMapping
+	err := DB.First(&mapping, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+func (m *ModelMapping) Insert() error {
+	return DB.Create(m).Error
+}
+
+func (m *ModelMapping) Update() error {
+	return DB.Save(m).Error
+}
+
+func (m *ModelMapping) Delete() error {
+	return DB.Delete(m).Error
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"time"
+)
+
+// ModelPrice defines what a call to a model costs. InputPrice and OutputPrice are
+// charged per 1K prompt/completion tokens, PerCallPrice once per successful call.
+type ModelPrice struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Model        string    `gorm:"size:64;uniqueIndex" json:"model"`
+	InputPrice   float64   `gorm:"default:0" json:"input_price"`
+	OutputPrice  float64   `gorm:"default:0" json:"output_price"`
+	PerCallPrice float64   `gorm:"default:0" json:"per_call_price"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func GetAllModelPrices() ([]ModelPrice, error) {
+	var prices []ModelPrice
+	err := DB.Order("model asc").Find(&prices).Error
+	return prices, err
+}
+
+func GetModelPriceByID(id uint) (*ModelPrice, error) {
+	var price ModelPrice
+	err := DB.First(&price, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
+
+func (p *ModelPrice) Insert() error {
+	return DB.Create(p).Error
+}
+
+func (p *ModelPrice) Update() error {
+	return DB.Save(p).Error
+}
+
+func (p *ModelPrice) Delete() error {
+	return DB.Delete(p).Error
+}
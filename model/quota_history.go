@@ -0,0 +1,57 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// QuotaHistory records how much of a periodic quota was used before it was reset.
+type QuotaHistory struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	SubjectType string    `gorm:"size:16;index:idx_quota_history_subject" json:"subject_type"`
+	SubjectID   uint      `gorm:"index:idx_quota_history_subject" json:"subject_id"`
+	Period      string    `gorm:"size:16" json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	QuotaTotal  int64     `json:"quota_total"`
+	QuotaUsed   int64     `json:"quota_used"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+}
+
+func GetQuotaHistory(page, pageSize int, subjectType string, subjectID uint) ([]QuotaHistory, int64, error) {
+	var history []QuotaHistory
+	var total int64
+	query := DB.Model(&QuotaHistory{})
+	if subjectType != "" {
+		query = query.Where("subject_type = ?", subjectType)
+	}
+	if subjectID > 0 {
+		query = query.Where("subject_id = ?", subjectID)
+	}
+	query.Count(&total)
+	err := query.Order("id desc").Offset((page - 1) * pageSize).Limit(pageSize).Find(&history).Error
+	return history, total, err
+}
+
+// ResetQuotaPeriod stores history and starts a new period for the user or token
+// row in table. Only the usage recorded in history is subtracted, so increments
+// that land between reading and resetting carry over into the new period.
+func ResetQuotaPeriod(table interface{}, id uint, history *QuotaHistory, nextReset int64) error {
+	switch table.(type) {
+	case *User:
+		defer InvalidateUserCache(id)
+	case *Token:
+		defer InvalidateTokenCache(id)
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(history).Error; err != nil {
+			return err
+		}
+		return tx.Model(table).Where("id = ?", id).
+			UpdateColumns(map[string]interface{}{
+				"quota_used":     gorm.Expr("CASE WHEN quota_used > ? THEN quota_used - ? ELSE 0 END", history.QuotaUsed, history.QuotaUsed),
+				"quota_reset_at": nextReset,
+			}).Error
+	})
+}
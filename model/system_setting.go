@@ -1,11 +1,57 @@
 package model
 
+import (
+	"cpa-distribution/common"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
 type SystemSetting struct {
 	Key   string `gorm:"primaryKey;size:128" json:"key"`
 	Value string `gorm:"type:text" json:"value"`
 }
 
+// Settings are read on the proxy hot path, so they are served from memory and
+// reloaded after every change and once a minute.
+var (
+	settingCache map[string]string
+	settingMutex sync.RWMutex
+)
+
+func InitSettingCache() {
+	RefreshSettingCache()
+	go func() {
+		ticker := time.NewTicker(60 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			RefreshSettingCache()
+		}
+	}()
+}
+
+func RefreshSettingCache() {
+	settings, err := GetAllSettings()
+	if err != nil {
+		log.Printf("Failed to refresh setting cache: %v", err)
+		return
+	}
+
+	settingMutex.Lock()
+	settingCache = settings
+	settingMutex.Unlock()
+}
+
 func GetSetting(key string) string {
+	settingMutex.RLock()
+	if settingCache != nil {
+		value := settingCache[key]
+		settingMutex.RUnlock()
+		return value
+	}
+	settingMutex.RUnlock()
+
 	var setting SystemSetting
 	if err := DB.Where("`key` = ?", key).First(&setting).Error; err != nil {
 		return ""
@@ -13,9 +59,35 @@ func GetSetting(key string) string {
 	return setting.Value
 }
 
+// GetSettingInt returns an integer setting, or defaultValue when it is unset or invalid.
+func GetSettingInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(GetSetting(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func SetSetting(key, value string) error {
 	setting := SystemSetting{Key: key, Value: value}
-	return DB.Where("`key` = ?", key).Assign(SystemSetting{Value: value}).FirstOrCreate(&setting).Error
+	err := DB.Where("`key` = ?", key).Assign(SystemSetting{Value: value}).FirstOrCreate(&setting).Error
+	if err == nil {
+		RefreshSettingCache()
+	}
+	return err
+}
+
+// GetQuotaMode returns how quota is charged: per request (default) or per token.
+func GetQuotaMode() string {
+	if GetSetting("quota_mode") == common.QuotaModeToken {
+		return common.QuotaModeToken
+	}
+	return common.QuotaModeRequest
+}
+
+// IsBillingEnabled reports whether requests are rejected once a user's balance runs out.
+func IsBillingEnabled() bool {
+	return GetSetting("billing_enabled") == "true"
 }
 
 func GetAllSettings() (map[string]string, error) {
@@ -40,5 +112,9 @@ func BatchSetSettings(settings map[string]string) error {
 			return err
 		}
 	}
-	return tx.Commit().Error
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	RefreshSettingCache()
+	return nil
 }
@@ -6,18 +6,23 @@ import (
 
 type Token struct {
 	gorm.Model
-	UserID        uint   `gorm:"index" json:"user_id"`
-	KeyHash       string `gorm:"size:64;uniqueIndex" json:"-"`
-	KeyPrefix     string `gorm:"size:20" json:"key_prefix"`
-	Name          string `gorm:"size:128" json:"name"`
-	Status        int    `gorm:"default:1" json:"status"`
-	ExpiresAt     *int64 `json:"expires_at"`
-	QuotaTotal    int64  `gorm:"default:-1" json:"quota_total"`
-	QuotaUsed     int64  `gorm:"default:0" json:"quota_used"`
-	RateLimitRPM  int    `gorm:"default:60" json:"rate_limit_rpm"`
-	AllowedModels string `gorm:"size:1024" json:"allowed_models"`
-	AllowedIPs    string `gorm:"size:1024" json:"allowed_ips"`
-	TotalRequests int64  `gorm:"default:0" json:"total_requests"`
+	UserID         uint   `gorm:"index" json:"user_id"`
+	KeyHash        string `gorm:"size:64;uniqueIndex" json:"-"`
+	KeyPrefix      string `gorm:"size:20" json:"key_prefix"`
+	Name           string `gorm:"size:128" json:"name"`
+	Status         int    `gorm:"default:1" json:"status"`
+	ExpiresAt      *int64 `json:"expires_at"`
+	QuotaTotal     int64  `gorm:"default:-1" json:"quota_total"`
+	QuotaUsed      int64  `gorm:"default:0" json:"quota_used"`
+	QuotaPeriod    string `gorm:"size:16;default:none" json:"quota_period"`
+	QuotaTimezone  string `gorm:"size:64" json:"quota_timezone"`
+	QuotaResetAt   *int64 `gorm:"index" json:"quota_reset_at"`
+	RateLimitRPM   int    `gorm:"default:60" json:"rate_limit_rpm"`
+	RateLimitTPM   int    `gorm:"default:0" json:"rate_limit_tpm"`
+	MaxConcurrency int    `gorm:"default:0" json:"max_concurrency"`
+	AllowedModels  string `gorm:"size:1024" json:"allowed_models"`
+	AllowedIPs     string `gorm:"size:1024" json:"allowed_ips"`
+	TotalRequests  int64  `gorm:"default:0" json:"total_requests"`
 }
 
 func GetTokenByHash(hash string) (*Token, error) {
@@ -48,11 +53,18 @@ func (t *Token) Insert() error {
 	return DB.Create(t).Error
 }
 
-func (t *Token) Update() error {
-	return DB.Save(t).Error
+// Update writes the given columns of t. Usage counters are left to
+// IncrementTokenUsage, which may have moved them since t was loaded.
+func (t *Token) Update(columns ...string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	defer InvalidateTokenCache(t.ID)
+	return DB.Model(t).Select(columns).Updates(t).Error
 }
 
 func (t *Token) Delete() error {
+	defer InvalidateTokenCache(t.ID)
 	return DB.Delete(t).Error
 }
 
@@ -62,10 +74,17 @@ func CountTokensByUserID(userID uint) int64 {
 	return count
 }
 
-func IncrementTokenUsage(tokenID uint) {
-	DB.Model(&Token{}).Where("id = ?", tokenID).
+func GetTokensDueForQuotaReset(now int64) ([]Token, error) {
+	var tokens []Token
+	err := DB.Where("quota_period <> ? AND quota_reset_at IS NOT NULL AND quota_reset_at <= ?", "none", now).
+		Find(&tokens).Error
+	return tokens, err
+}
+
+func IncrementTokenUsage(tokenID uint, quota int64, requests int64) error {
+	return DB.Model(&Token{}).Where("id = ?", tokenID).
 		UpdateColumns(map[string]interface{}{
-			"quota_used":     gorm.Expr("quota_used + 1"),
-			"total_requests": gorm.Expr("total_requests + 1"),
-		})
+			"quota_used":     gorm.Expr("quota_used + ?", quota),
+			"total_requests": gorm.Expr("total_requests + ?", requests),
+		}).Error
 }
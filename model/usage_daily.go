@@ -0,0 +1,269 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UsageDaily is the per-day rollup of request logs. It is updated in the same
+// transaction that inserts the logs and outlives log retention.
+type UsageDaily struct {
+	ID               uint    `gorm:"primaryKey" json:"id"`
+	Date             string  `gorm:"size:10;uniqueIndex:idx_usage_daily_key" json:"date"`
+	UserID           uint    `gorm:"uniqueIndex:idx_usage_daily_key;index" json:"user_id"`
+	TokenID          uint    `gorm:"uniqueIndex:idx_usage_daily_key" json:"token_id"`
+	Model            string  `gorm:"size:64;uniqueIndex:idx_usage_daily_key" json:"model"`
+	ChannelID        uint    `gorm:"uniqueIndex:idx_usage_daily_key" json:"channel_id"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+	DurationSum      int64   `json:"duration_sum"`
+	FirstTokenSum    int64   `json:"first_token_sum"`
+	FirstTokenCount  int64   `json:"first_token_count"`
+}
+
+// usageDate is the rollup date of a log, in server local time.
+func usageDate(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// usageRollup sums logs into UsageDaily rows keyed like the unique index.
+type usageRollup struct {
+	groups map[usageKey]*UsageDaily
+	rows   []*UsageDaily
+}
+
+type usageKey struct {
+	date      string
+	userID    uint
+	tokenID   uint
+	model     string
+	channelID uint
+}
+
+func (r *usageRollup) add(l RequestLog) {
+	k := usageKey{usageDate(l.CreatedAt), l.UserID, l.TokenID, l.Model, l.ChannelID}
+	row, exists := r.groups[k]
+	if !exists {
+		if r.groups == nil {
+			r.groups = make(map[usageKey]*UsageDaily)
+		}
+		row = &UsageDaily{Date: k.date, UserID: k.userID, TokenID: k.tokenID, Model: k.model, ChannelID: k.channelID}
+		r.groups[k] = row
+		r.rows = append(r.rows, row)
+	}
+	row.Requests++
+	if l.IsError() {
+		row.Errors++
+	}
+	row.PromptTokens += int64(l.PromptTokens)
+	row.CompletionTokens += int64(l.CompletionTokens)
+	row.TotalTokens += int64(l.TotalTokens)
+	row.Cost += l.Cost
+	row.DurationSum += int64(l.Duration)
+	if l.FirstTokenTime > 0 {
+		row.FirstTokenSum += int64(l.FirstTokenTime)
+		row.FirstTokenCount++
+	}
+}
+
+// rollupLogs adds logs to their UsageDaily rows.
+func rollupLogs(tx *gorm.DB, logs []RequestLog) error {
+	var rollup usageRollup
+	for _, l := range logs {
+		rollup.add(l)
+	}
+	return upsertUsageDaily(tx, rollup.rows)
+}
+
+// upsertUsageDaily adds rows to the existing rows with the same key.
+func upsertUsageDaily(tx *gorm.DB, rows []*UsageDaily) error {
+	assignments := make(map[string]interface{})
+	for _, column := range []string{"requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens",
+		"cost", "duration_sum", "first_token_sum", "first_token_count"} {
+		assignments[column] = gorm.Expr("usage_dailies." + column + " + excluded." + column)
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "date"}, {Name: "user_id"}, {Name: "token_id"}, {Name: "model"}, {Name: "channel_id"},
+		},
+		DoUpdates: clause.Assignments(assignments),
+	}).CreateInBatches(rows, 100).Error
+}
+
+// backfillChunkSize is how many logs are read per query.
+const backfillChunkSize = 5000
+
+// BackfillUsageDaily rebuilds the rollup from the request logs, replacing the
+// rows of each date that has logs in one transaction per date. It should run
+// while the server is stopped. Older rows, whose logs were removed by
+// retention, are kept, and so is the oldest date with logs if it already has
+// rows: retention cuts mid-day, so its remaining logs are not the whole day.
+func BackfillUsageDaily() (int64, error) {
+	var first RequestLog
+	err := DB.Select("created_at").Order("id").Limit(1).Find(&first).Error
+	if err != nil || first.CreatedAt.IsZero() {
+		return 0, err
+	}
+	oldest := usageDate(first.CreatedAt)
+	var kept int64
+	if err := DB.Model(&UsageDaily{}).Where("date = ?", oldest).Count(&kept).Error; err != nil {
+		return 0, err
+	}
+
+	// The rollup of all dates is held in memory so that each date is replaced
+	// at once even if its logs are not contiguous by id
+	rollups := make(map[string]*usageRollup)
+	var dates []string
+	var total int64
+	var lastID uint
+	for {
+		var logs []RequestLog
+		err := DB.Select("id, user_id, token_id, model, channel_id, status_code, error_type, duration, first_token_time, prompt_tokens, completion_tokens, total_tokens, cost, created_at").
+			Where("id > ?", lastID).Order("id").Limit(backfillChunkSize).Find(&logs).Error
+		if err != nil {
+			return 0, err
+		}
+		if len(logs) == 0 {
+			break
+		}
+		for _, l := range logs {
+			date := usageDate(l.CreatedAt)
+			if date < oldest || date == oldest && kept > 0 {
+				continue
+			}
+			rollup, exists := rollups[date]
+			if !exists {
+				rollup = &usageRollup{}
+				rollups[date] = rollup
+				dates = append(dates, date)
+			}
+			rollup.add(l)
+			total++
+		}
+		lastID = logs[len(logs)-1].ID
+	}
+
+	var done int64
+	for _, date := range dates {
+		rows := rollups[date].rows
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("date = ?", date).Delete(&UsageDaily{}).Error; err != nil {
+				return err
+			}
+			return upsertUsageDaily(tx, rows)
+		})
+		if err != nil {
+			return done, err
+		}
+		for _, row := range rows {
+			done += row.Requests
+		}
+	}
+	return total, nil
+}
+
+// DailyUsage is the usage of one day in a trend.
+type DailyUsage struct {
+	Date     string  `json:"date"`
+	Requests int64   `json:"count"`
+	Tokens   int64   `json:"tokens"`
+	Cost     float64 `json:"cost"`
+}
+
+// GetUsageTrend returns the usage of each of the last days days, oldest first.
+// Days without requests are included with zero counts.
+func GetUsageTrend(days int) ([]DailyUsage, error) {
+	start := time.Now().AddDate(0, 0, -(days - 1))
+	var rows []DailyUsage
+	err := DB.Model(&UsageDaily{}).
+		Select("date, SUM(requests) as requests, SUM(total_tokens) as tokens, SUM(cost) as cost").
+		Where("date >= ?", usageDate(start)).
+		Group("date").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	byDate := make(map[string]DailyUsage, len(rows))
+	for _, row := range rows {
+		byDate[row.Date] = row
+	}
+
+	trend := make([]DailyUsage, 0, days)
+	for i := 0; i < days; i++ {
+		date := usageDate(start.AddDate(0, 0, i))
+		day := byDate[date]
+		day.Date = date
+		trend = append(trend, day)
+	}
+	return trend, nil
+}
+
+// ModelUsage is the all-time usage of one model.
+type ModelUsage struct {
+	Model string  `json:"model"`
+	Count int64   `json:"count"`
+	Cost  float64 `json:"cost"`
+}
+
+// GetTopModels returns the limit models with the most requests.
+func GetTopModels(limit int) ([]ModelUsage, error) {
+	var result []ModelUsage
+	err := DB.Model(&UsageDaily{}).
+		Select("model, SUM(requests) as count, COALESCE(SUM(cost), 0) as cost").
+		Where("model != ''").
+		Group("model").
+		Order("count DESC").
+		Limit(limit).
+		Scan(&result).Error
+	return result, err
+}
+
+// MonthlyUsage is the usage of one user in one month.
+type MonthlyUsage struct {
+	Month            string  `json:"month"`
+	UserID           uint    `json:"user_id"`
+	Username         string  `json:"username"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// GetMonthlyUsage returns per-user monthly totals from the rollup. The user,
+// token, model and time range of filter apply, the latter by day; IP does not.
+func GetMonthlyUsage(filter LogFilter) ([]MonthlyUsage, error) {
+	query := DB.Model(&UsageDaily{}).
+		Select("SUBSTR(usage_dailies.date, 1, 7) as month, usage_dailies.user_id, users.username, " +
+			"SUM(requests) as requests, SUM(errors) as errors, SUM(prompt_tokens) as prompt_tokens, " +
+			"SUM(completion_tokens) as completion_tokens, SUM(total_tokens) as total_tokens, SUM(cost) as cost").
+		Joins("LEFT JOIN users ON users.id = usage_dailies.user_id")
+	if filter.UserID > 0 {
+		query = query.Where("usage_dailies.user_id = ?", filter.UserID)
+	}
+	if filter.TokenID > 0 {
+		query = query.Where("usage_dailies.token_id = ?", filter.TokenID)
+	}
+	if filter.Model != "" {
+		query = query.Where("usage_dailies.model = ?", filter.Model)
+	}
+	if filter.Start != nil {
+		query = query.Where("usage_dailies.date >= ?", usageDate(*filter.Start))
+	}
+	if filter.End != nil {
+		query = query.Where("usage_dailies.date <= ?", usageDate(filter.End.Add(-time.Second)))
+	}
+
+	var result []MonthlyUsage
+	err := query.Group("month, usage_dailies.user_id, users.username").
+		Order("month, usage_dailies.user_id").
+		Scan(&result).Error
+	return result, err
+}
@@ -6,18 +6,24 @@ import (
 
 type User struct {
 	gorm.Model
-	LinuxDOID   int    `gorm:"uniqueIndex;column:linux_do_id" json:"linux_do_id"`
-	Username    string `gorm:"size:64;uniqueIndex" json:"username"`
-	DisplayName string `gorm:"size:128" json:"display_name"`
-	AvatarURL   string `gorm:"size:512" json:"avatar_url"`
-	TrustLevel  int    `json:"trust_level"`
-	Role        int    `gorm:"default:1" json:"role"`
-	Status      int    `gorm:"default:1" json:"status"`
-	QuotaTotal  int64  `gorm:"default:1000" json:"quota_total"`
-	QuotaUsed   int64  `gorm:"default:0" json:"quota_used"`
-	TokenLimit  int    `gorm:"default:5" json:"token_limit"`
-	LastLoginAt *int64 `json:"last_login_at"`
-	LastLoginIP string `gorm:"size:45" json:"last_login_ip"`
+	LinuxDOID      int     `gorm:"uniqueIndex;column:linux_do_id" json:"linux_do_id"`
+	Username       string  `gorm:"size:64;uniqueIndex" json:"username"`
+	DisplayName    string  `gorm:"size:128" json:"display_name"`
+	AvatarURL      string  `gorm:"size:512" json:"avatar_url"`
+	TrustLevel     int     `json:"trust_level"`
+	Role           int     `gorm:"default:1" json:"role"`
+	Status         int     `gorm:"default:1" json:"status"`
+	QuotaTotal     int64   `gorm:"default:1000" json:"quota_total"`
+	QuotaUsed      int64   `gorm:"default:0" json:"quota_used"`
+	QuotaPeriod    string  `gorm:"size:16;default:none" json:"quota_period"`
+	QuotaTimezone  string  `gorm:"size:64" json:"quota_timezone"`
+	QuotaResetAt   *int64  `gorm:"index" json:"quota_reset_at"`
+	TokenLimit     int     `gorm:"default:5" json:"token_limit"`
+	Balance        float64 `gorm:"default:0" json:"balance"`
+	RateLimitTPM   int     `gorm:"default:0" json:"rate_limit_tpm"`
+	MaxConcurrency int     `gorm:"default:0" json:"max_concurrency"`
+	LastLoginAt    *int64  `json:"last_login_at"`
+	LastLoginIP    string  `gorm:"size:45" json:"last_login_ip"`
 }
 
 func GetUserByLinuxDOID(id int) (*User, error) {
@@ -50,8 +56,29 @@ func (u *User) Insert() error {
 	return DB.Create(u).Error
 }
 
-func (u *User) Update() error {
-	return DB.Save(u).Error
+// Update writes the given columns of u. Usage counters are left to
+// IncrementUserUsage, which may have moved them since u was loaded.
+func (u *User) Update(columns ...string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+	defer InvalidateUserCache(u.ID)
+	return DB.Model(u).Select(columns).Updates(u).Error
+}
+
+func IncrementUserUsage(userID uint, quota int64, cost float64) error {
+	return DB.Model(&User{}).Where("id = ?", userID).
+		UpdateColumns(map[string]interface{}{
+			"quota_used": gorm.Expr("quota_used + ?", quota),
+			"balance":    gorm.Expr("balance - ?", cost),
+		}).Error
+}
+
+func GetUsersDueForQuotaReset(now int64) ([]User, error) {
+	var users []User
+	err := DB.Where("quota_period <> ? AND quota_reset_at IS NOT NULL AND quota_reset_at <= ?", "none", now).
+		Find(&users).Error
+	return users, err
 }
 
 func GetUserCount() int64 {
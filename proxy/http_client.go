@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"cpa-distribution/model"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// errStreamIdle is the cancel cause used when the upstream stops sending data.
+var errStreamIdle = errors.New("no data received from upstream")
+
+// UpstreamTimeoutError is an upstream failure caused by one of the configured
+// timeouts, so it can be reported apart from other gateway errors.
+type UpstreamTimeoutError struct {
+	Phase string
+	Err   error
+}
+
+func (e *UpstreamTimeoutError) Error() string {
+	return fmt.Sprintf("upstream timeout (%s): %v", e.Phase, e.Err)
+}
+
+func (e *UpstreamTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// classifyUpstreamError wraps timeouts in an UpstreamTimeoutError naming the
+// phase that timed out and returns other errors unchanged.
+func classifyUpstreamError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var timeoutErr *UpstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return err
+	}
+	if errors.Is(context.Cause(ctx), errStreamIdle) {
+		return &UpstreamTimeoutError{Phase: "stream_idle", Err: errStreamIdle}
+	}
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return &UpstreamTimeoutError{Phase: "dial", Err: err}
+	case strings.Contains(err.Error(), "TLS handshake"):
+		return &UpstreamTimeoutError{Phase: "tls_handshake", Err: err}
+	case strings.Contains(err.Error(), "awaiting response headers"):
+		return &UpstreamTimeoutError{Phase: "response_header", Err: err}
+	}
+	return &UpstreamTimeoutError{Phase: "unknown", Err: err}
+}
+
+// isConnectError reports whether err happened before the request reached the
+// upstream (dial or TLS handshake), so it is safe to send it to another
+// channel. Once the request was written the upstream may already be working on
+// it, and retrying would duplicate the (billed) work or multiply the wait.
+func isConnectError(err error) bool {
+	var timeoutErr *UpstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr.Phase == "dial" || timeoutErr.Phase == "tls_handshake"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		return true
+	}
+	var tlsErr *tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	return errors.As(err, &tlsErr) || errors.As(err, &certErr)
+}
+
+// errorTypeOf returns the log error type for a failure while reading an
+// upstream body, or "" when there is none. Client disconnects cancel the
+// context and are not upstream errors.
+func errorTypeOf(ctx context.Context, err error) string {
+	var timeoutErr *UpstreamTimeoutError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &timeoutErr):
+		return model.ErrorTypeTimeout
+	case errors.Is(err, errResponseTooLarge):
+		return model.ErrorTypeTooLarge
+	case ctx.Err() != nil:
+		return ""
+	}
+	return model.ErrorTypeUpstream
+}
+
+// idleTimeoutReader cancels the upstream request when no data arrives within
+// timeout, so a hung upstream cannot hold the connection open forever.
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelCauseFunc) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	return &idleTimeoutReader{
+		ReadCloser: body,
+		timer:      time.AfterFunc(timeout, func() { cancel(errStreamIdle) }),
+		timeout:    timeout,
+	}
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.ReadCloser.Close()
+}
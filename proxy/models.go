@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"cpa-distribution/model"
+	"cpa-distribution/service"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	modelListTTL = 5 * time.Minute
+	// modelListRetryBackoff is how long to wait after every channel failed
+	// before fetching again, so an upstream outage is not hit on every request.
+	modelListRetryBackoff = 30 * time.Second
+)
+
+type modelEntry struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+var (
+	upstreamModels    []modelEntry
+	upstreamModelsAt  time.Time
+	modelListFailedAt time.Time
+	modelListMutex    sync.Mutex
+	modelListGroup    singleflight.Group
+)
+
+// ListModels answers GET /v1/models locally: the cached upstream catalogue plus
+// configured aliases, filtered by the calling token's allowed models.
+func ListModels(c *gin.Context) {
+	entries := make(map[string]modelEntry)
+	for _, m := range getUpstreamModels() {
+		entries[m.ID] = m
+	}
+	now := time.Now().Unix()
+	for _, alias := range service.ModelAliases() {
+		if _, exists := entries[alias]; !exists {
+			entries[alias] = modelEntry{ID: alias, Object: "model", Created: now, OwnedBy: "system"}
+		}
+	}
+
+	data := make([]modelEntry, 0, len(entries))
+	for _, m := range entries {
+		if isModelAllowed(c, m.ID) {
+			data = append(data, m)
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].ID < data[j].ID })
+
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// getUpstreamModels returns the cached upstream catalogue. A stale list is
+// served as is while one background fetch refreshes it; only the very first
+// call waits for the upstream.
+func getUpstreamModels() []modelEntry {
+	modelListMutex.Lock()
+	models := upstreamModels
+	fresh := models != nil && time.Since(upstreamModelsAt) < modelListTTL
+	backingOff := time.Since(modelListFailedAt) < modelListRetryBackoff
+	modelListMutex.Unlock()
+
+	if fresh || backingOff {
+		return models
+	}
+	if models != nil {
+		modelListGroup.DoChan("models", refreshUpstreamModels)
+		return models
+	}
+	result, _, _ := modelListGroup.Do("models", refreshUpstreamModels)
+	return result.([]modelEntry)
+}
+
+// refreshUpstreamModels fetches the catalogue from the first channel that
+// answers. When all fail, the failure is remembered for modelListRetryBackoff
+// and the previous list is kept.
+func refreshUpstreamModels() (interface{}, error) {
+	for _, ch := range service.SelectChannels() {
+		models, err := fetchUpstreamModels(ch)
+		if err != nil {
+			log.Printf("Failed to fetch model list from channel %d (%s): %v", ch.ID, ch.Name, err)
+			continue
+		}
+		modelListMutex.Lock()
+		upstreamModels = models
+		upstreamModelsAt = time.Now()
+		modelListMutex.Unlock()
+		return models, nil
+	}
+
+	modelListMutex.Lock()
+	defer modelListMutex.Unlock()
+	modelListFailedAt = time.Now()
+	return upstreamModels, nil
+}
+
+func fetchUpstreamModels(ch model.Channel) ([]modelEntry, error) {
+	base, err := url.Parse(ch.BaseURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid base URL")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(ch.BaseURL, "/")+"/v1/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ch.Key)
+
+	client := &http.Client{Transport: service.UpstreamTransport(), Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Data []modelEntry `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	models := make([]modelEntry, 0, len(list.Data))
+	for _, m := range list.Data {
+		if m.ID == "" {
+			continue
+		}
+		if m.Object == "" {
+			m.Object = "model"
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// isModelAllowed checks name against the token's AllowedModels list. Tokens
+// without a list may use every model.
+func isModelAllowed(c *gin.Context, name string) bool {
+	allowedModels, exists := c.Get("allowed_models")
+	if !exists {
+		return true
+	}
+	allowed := allowedModels.(string)
+	if allowed == "" {
+		return true
+	}
+	for _, m := range strings.Split(allowed, ",") {
+		if strings.TrimSpace(m) == name {
+			return true
+		}
+	}
+	return false
+}
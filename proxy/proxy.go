@@ -2,49 +2,58 @@ package proxy
 
 import (
 	"bytes"
-	"cpa-distribution/common"
+	"context"
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
 	"cpa-distribution/service"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func ProxyHandler(c *gin.Context) {
-	upstreamURL := common.CPAUpstreamURL
-	upstreamKey := common.CPAUpstreamKey
+// inFlight tracks proxied requests until their logs have been recorded.
+var inFlight sync.WaitGroup
 
-	// Allow override from system settings
-	if settingURL := model.GetSetting("cpa_upstream_url"); settingURL != "" {
-		upstreamURL = settingURL
-	}
-	if settingKey := model.GetSetting("cpa_upstream_key"); settingKey != "" {
-		upstreamKey = settingKey
+// WaitInFlight waits until all proxied requests have finished or ctx is done.
+func WaitInFlight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	if upstreamURL == "" || upstreamKey == "" {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"error": gin.H{
-				"message": "Upstream not configured",
-				"type":    "server_error",
-			},
-		})
+func ProxyHandler(c *gin.Context) {
+	inFlight.Add(1)
+	defer inFlight.Done()
+
+	// gin cannot register /models next to the /*path catch-all, so dispatch here
+	if c.Request.Method == http.MethodGet && c.Request.URL.Path == "/v1/models" {
+		ListModels(c)
 		return
 	}
 
-	target, err := url.Parse(upstreamURL)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	channels := service.SelectChannels()
+	if len(channels) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"error": gin.H{
-				"message": "Invalid upstream URL",
+				"message": "Upstream not configured",
 				"type":    "server_error",
 			},
 		})
@@ -52,134 +61,233 @@ func ProxyHandler(c *gin.Context) {
 	}
 
 	startTime := time.Now()
+	requestPath := c.Request.URL.Path
 
-	// Read request body to extract model name
+	// Read request body to extract model name. The body is kept for failover,
+	// so it is bounded by max_request_body_mb.
+	limits := service.GetBodyLimitConfig()
 	var bodyBytes []byte
 	var requestModel string
 	var isStream bool
 	if c.Request.Body != nil {
-		bodyBytes, _ = io.ReadAll(c.Request.Body)
+		maxRequest := limits.MaxRequestBytes()
+		body := c.Request.Body
+		if maxRequest > 0 {
+			if c.Request.ContentLength > maxRequest {
+				rejectTooLarge(c, maxRequest)
+				return
+			}
+			body = http.MaxBytesReader(c.Writer, body, maxRequest)
+		}
+		var err error
+		bodyBytes, err = io.ReadAll(body)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejectTooLarge(c, maxRequest)
+			return
+		}
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-		var reqBody map[string]interface{}
+		// Only the two fields are decoded; the rest of the body is skipped
+		var reqBody struct {
+			Model  interface{} `json:"model"`
+			Stream interface{} `json:"stream"`
+		}
 		if json.Unmarshal(bodyBytes, &reqBody) == nil {
-			if m, ok := reqBody["model"].(string); ok {
+			if m, ok := reqBody.Model.(string); ok {
 				requestModel = m
 			}
-			if s, ok := reqBody["stream"].(bool); ok {
+			if s, ok := reqBody.Stream.(bool); ok {
 				isStream = s
 			}
 		}
 	}
 
+	// Gemini-style routes carry the model in the path, e.g.
+	// /v1beta/models/gemini-pro:streamGenerateContent
+	pathModel, action := parseModelPath(requestPath)
+	if pathModel != "" {
+		requestModel = pathModel
+		isStream = action == "streamGenerateContent"
+	}
+
 	// Check allowed models
-	if allowedModels, exists := c.Get("allowed_models"); exists {
-		allowed := allowedModels.(string)
-		if allowed != "" && requestModel != "" {
-			modelAllowed := false
-			for _, m := range strings.Split(allowed, ",") {
-				if strings.TrimSpace(m) == requestModel {
-					modelAllowed = true
-					break
-				}
-			}
-			if !modelAllowed {
-				c.JSON(http.StatusForbidden, gin.H{
-					"error": gin.H{
-						"message": "Model not allowed: " + requestModel,
-						"type":    "invalid_request_error",
-					},
-				})
-				return
-			}
+	if requestModel != "" && !isModelAllowed(c, requestModel) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": gin.H{
+				"message": "Model not allowed: " + requestModel,
+				"type":    "invalid_request_error",
+			},
+		})
+		return
+	}
+
+	// Rewrite the model name to the upstream identifier
+	upstreamModel := service.MapModel(requestModel)
+	if upstreamModel != requestModel && pathModel != "" {
+		c.Request.URL.Path = strings.Replace(requestPath, "/models/"+pathModel+":", "/models/"+upstreamModel+":", 1)
+		c.Request.URL.RawPath = ""
+	} else if upstreamModel != requestModel {
+		if rewritten, ok := rewriteModelField(bodyBytes, upstreamModel); ok {
+			bodyBytes = rewritten
+			c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+			c.Request.ContentLength = int64(len(bodyBytes))
+		}
+	}
+
+	// OpenAI only reports usage for streams when asked to, and a stream without
+	// usage would be logged and billed as zero tokens. When the client did not
+	// ask, the usage chunk is read and then kept from it
+	hideUsage := false
+	if isStream && pathModel == "" && strings.HasSuffix(requestPath, "/completions") {
+		if rewritten, ok := enableStreamUsage(bodyBytes); ok {
+			hideUsage = true
+			bodyBytes = rewritten
+			c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+			c.Request.ContentLength = int64(len(bodyBytes))
 		}
 	}
 
 	tokenID, _ := c.Get("token_id")
 	userID, _ := c.Get("token_user_id")
 
+	transport := &failoverTransport{
+		base:     service.UpstreamTransport(),
+		channels: channels,
+		body:     bodyBytes,
+	}
+
+	// Cancelled with errStreamIdle when the upstream stops sending data
+	ctx, cancel := context.WithCancelCause(c.Request.Context())
+	defer cancel(nil)
+	c.Request = c.Request.WithContext(ctx)
+	idleTimeout := time.Duration(service.GetTimeoutConfig().StreamIdle) * time.Second
+
 	proxy := httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.URL.Scheme = target.Scheme
-			req.URL.Host = target.Host
-			req.Host = target.Host
-			// Keep original path (e.g., /v1/chat/completions)
-			req.Header.Set("Authorization", "Bearer "+upstreamKey)
+			// Target host, auth and the original path (e.g., /v1/chat/completions)
+			// are applied per channel by failoverTransport
 			req.Header.Del("Cookie")
 		},
+		Transport: transport,
 		ModifyResponse: func(resp *http.Response) error {
-			duration := int(time.Since(startTime).Milliseconds())
+			resp.Body = newIdleTimeoutReader(resp.Body, idleTimeout, cancel)
 
 			if isStream {
 				// For streaming responses, wrap the body to capture usage
+				metrics.ActiveStreams.Inc()
 				resp.Body = &streamReader{
-					reader:   resp.Body,
-					tokenID:  tokenID.(uint),
-					userID:   userID.(uint),
-					model:    requestModel,
-					path:     c.Request.URL.Path,
-					method:   c.Request.Method,
-					ip:       getRequestIP(c),
-					status:   resp.StatusCode,
-					duration: duration,
+					reader:    resp.Body,
+					ctx:       ctx,
+					ginCtx:    c,
+					tokenID:   tokenID.(uint),
+					userID:    userID.(uint),
+					channelID: transport.channelID(),
+					model:     requestModel,
+					upstream:  upstreamModel,
+					path:      requestPath,
+					method:    c.Request.Method,
+					ip:        getRequestIP(c),
+					status:    resp.StatusCode,
+					attempts:  transport.attempts,
+					startTime: startTime,
+					hideUsage: hideUsage,
 				}
 			} else {
-				// For non-streaming, read body, extract usage, re-wrap
-				body, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err == nil {
-					var usage UsageInfo
-					extractUsageFromJSON(body, &usage)
-
-					logEntry := model.RequestLog{
-						UserID:           userID.(uint),
-						TokenID:          tokenID.(uint),
-						RequestIP:        getRequestIP(c),
-						Method:           c.Request.Method,
-						Path:             c.Request.URL.Path,
-						Model:            requestModel,
-						StatusCode:       resp.StatusCode,
-						Duration:         duration,
-						PromptTokens:     usage.PromptTokens,
-						CompletionTokens: usage.CompletionTokens,
-						TotalTokens:      usage.TotalTokens,
-						CreatedAt:        time.Now(),
-					}
-					service.RecordLog(logEntry)
-
-					if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-						service.IncrementUsage(tokenID.(uint), userID.(uint))
-					}
-
-					resp.Body = io.NopCloser(bytes.NewBuffer(body))
-					resp.ContentLength = int64(len(body))
+				// For non-streaming, pass the body through and parse usage as it goes
+				maxResponse := limits.MaxResponseBytes()
+				if maxResponse > 0 && resp.ContentLength > maxResponse {
+					resp.Body.Close()
+					return errResponseTooLarge
+				}
+				status := resp.StatusCode
+				channelID := transport.channelID()
+				resp.Body = &responseReader{
+					reader: resp.Body,
+					ctx:    ctx,
+					limit:  maxResponse,
+					onDone: func(usage UsageInfo, err error) {
+						// Reported back to RateLimit for TPM accounting
+						c.Set("usage_total_tokens", usage.TotalTokens)
+
+						logEntry := model.RequestLog{
+							UserID:           userID.(uint),
+							TokenID:          tokenID.(uint),
+							ChannelID:        channelID,
+							RequestIP:        getRequestIP(c),
+							Method:           c.Request.Method,
+							Path:             requestPath,
+							Model:            requestModel,
+							UpstreamModel:    upstreamModel,
+							StatusCode:       status,
+							Attempts:         transport.attempts,
+							Duration:         int(time.Since(startTime).Milliseconds()),
+							PromptTokens:     usage.PromptTokens,
+							CompletionTokens: usage.CompletionTokens,
+							TotalTokens:      usage.TotalTokens,
+							CreatedAt:        time.Now(),
+						}
+						if errorType := errorTypeOf(ctx, err); errorType != "" {
+							logEntry.ErrorType = errorType
+							logEntry.ErrorMessage = err.Error()
+						}
+						if status >= 200 && status < 300 {
+							logEntry.Cost = service.CalculateCost(requestModel, usage.PromptTokens, usage.CompletionTokens)
+							service.IncrementUsage(logEntry)
+						}
+						service.RecordLog(logEntry)
+					},
 				}
 			}
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			err = classifyUpstreamError(ctx, err)
 			log.Printf("Proxy error: %v", err)
 			duration := int(time.Since(startTime).Milliseconds())
 
+			status := http.StatusBadGateway
+			message := "Upstream service unavailable"
+			errorType := model.ErrorTypeUpstream
+			var timeoutErr *UpstreamTimeoutError
+			if errors.Is(err, errResponseTooLarge) {
+				// The client's request was fine; the upstream answered with more than we relay
+				message = "Upstream response exceeds the configured size limit (max_response_body_mb)"
+				errorType = model.ErrorTypeTooLarge
+			} else if errors.As(err, &timeoutErr) {
+				status = http.StatusGatewayTimeout
+				message = "Upstream request timed out (" + timeoutErr.Phase + ")"
+				errorType = model.ErrorTypeTimeout
+			} else if errors.Is(err, service.ErrCircuitOpen) {
+				// Fail fast instead of waiting on an upstream known to be down
+				status = http.StatusServiceUnavailable
+				message = "Upstream temporarily unavailable (circuit breaker open), please retry later"
+				errorType = model.ErrorTypeCircuitOpen
+			}
+
 			logEntry := model.RequestLog{
-				UserID:       userID.(uint),
-				TokenID:      tokenID.(uint),
-				RequestIP:    getRequestIP(c),
-				Method:       c.Request.Method,
-				Path:         c.Request.URL.Path,
-				Model:        requestModel,
-				StatusCode:   502,
-				Duration:     duration,
-				ErrorMessage: err.Error(),
-				CreatedAt:    time.Now(),
+				UserID:        userID.(uint),
+				TokenID:       tokenID.(uint),
+				ChannelID:     transport.channelID(),
+				RequestIP:     getRequestIP(c),
+				Method:        c.Request.Method,
+				Path:          requestPath,
+				Model:         requestModel,
+				UpstreamModel: upstreamModel,
+				StatusCode:    status,
+				Attempts:      transport.attempts,
+				Duration:      duration,
+				ErrorType:     errorType,
+				ErrorMessage:  err.Error(),
+				CreatedAt:     time.Now(),
 			}
 			service.RecordLog(logEntry)
 
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadGateway)
+			w.WriteHeader(status)
 			json.NewEncoder(w).Encode(gin.H{
 				"error": gin.H{
-					"message": "Upstream service unavailable",
+					"message": message,
 					"type":    "server_error",
 				},
 			})
@@ -189,6 +297,77 @@ func ProxyHandler(c *gin.Context) {
 	proxy.ServeHTTP(c.Writer, c.Request)
 }
 
+// parseModelPath extracts the model and action from Gemini-style paths such as
+// /v1beta/models/{model}:generateContent.
+func parseModelPath(path string) (string, string) {
+	idx := strings.LastIndex(path, "/models/")
+	if idx < 0 {
+		return "", ""
+	}
+	modelName, action, found := strings.Cut(path[idx+len("/models/"):], ":")
+	if !found || modelName == "" || strings.Contains(modelName, "/") {
+		return "", ""
+	}
+	return modelName, action
+}
+
+// rewriteModelField replaces the top-level "model" field of a JSON body.
+func rewriteModelField(body []byte, modelName string) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return nil, false
+	}
+	encoded, err := json.Marshal(modelName)
+	if err != nil {
+		return nil, false
+	}
+	fields["model"] = encoded
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// enableStreamUsage sets stream_options.include_usage in a chat/completions
+// body, keeping any other stream options. It reports false when the body is
+// not a JSON object or already asks for usage.
+func enableStreamUsage(body []byte) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || fields == nil {
+		return nil, false
+	}
+	var options map[string]json.RawMessage
+	if raw, exists := fields["stream_options"]; exists {
+		json.Unmarshal(raw, &options)
+	}
+	if options == nil {
+		options = make(map[string]json.RawMessage)
+	}
+	if string(options["include_usage"]) == "true" {
+		return nil, false
+	}
+	options["include_usage"] = json.RawMessage("true")
+
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return nil, false
+	}
+	fields["stream_options"] = encoded
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// rejectTooLarge answers a request whose body exceeds max_request_body_mb.
+func rejectTooLarge(c *gin.Context, limit int64) {
+	metrics.Rejections.WithLabelValues("proxy", "body_too_large").Inc()
+	utils.SendOpenAIError(c, http.StatusRequestEntityTooLarge, "invalid_request_error",
+		fmt.Sprintf("Request body exceeds the %d MB limit", limit>>20))
+}
+
 func getRequestIP(c *gin.Context) string {
 	if ip, exists := c.Get("request_ip"); exists {
 		return ip.(string)
@@ -208,14 +387,44 @@ func extractUsageFromJSON(body []byte, usage *UsageInfo) {
 		return
 	}
 	if u, ok := resp["usage"].(map[string]interface{}); ok {
-		if v, ok := u["prompt_tokens"].(float64); ok {
-			usage.PromptTokens = int(v)
-		}
-		if v, ok := u["completion_tokens"].(float64); ok {
-			usage.CompletionTokens = int(v)
-		}
-		if v, ok := u["total_tokens"].(float64); ok {
-			usage.TotalTokens = int(v)
+		applyUsage(u, usage)
+	}
+	if u, ok := resp["usageMetadata"].(map[string]interface{}); ok {
+		applyUsage(u, usage)
+	}
+}
+
+// applyUsage copies the counters present in a usage object onto usage. It
+// understands OpenAI (prompt_tokens/completion_tokens), Anthropic
+// (input_tokens/output_tokens) and Gemini usageMetadata field names; absent
+// fields are left unchanged.
+func applyUsage(u map[string]interface{}, usage *UsageInfo) {
+	if v, ok := u["prompt_tokens"].(float64); ok {
+		usage.PromptTokens = int(v)
+	}
+	if v, ok := u["completion_tokens"].(float64); ok {
+		usage.CompletionTokens = int(v)
+	}
+	if v, ok := u["input_tokens"].(float64); ok {
+		usage.PromptTokens = int(v)
+	}
+	if v, ok := u["output_tokens"].(float64); ok {
+		usage.CompletionTokens = int(v)
+	}
+	if v, ok := u["promptTokenCount"].(float64); ok {
+		usage.PromptTokens = int(v)
+	}
+	if v, ok := u["candidatesTokenCount"].(float64); ok {
+		usage.CompletionTokens = int(v)
+		if thoughts, ok := u["thoughtsTokenCount"].(float64); ok {
+			usage.CompletionTokens += int(thoughts)
 		}
 	}
+	if v, ok := u["total_tokens"].(float64); ok {
+		usage.TotalTokens = int(v)
+	} else if v, ok := u["totalTokenCount"].(float64); ok {
+		usage.TotalTokens = int(v)
+	} else {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
 }
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	// usageCaptureSize is how much of a response is kept for a full JSON parse.
+	usageCaptureSize = 1 << 20
+	// usageTailSize is how much of the end of a larger response is kept; usage
+	// objects come after the content in every supported format.
+	usageTailSize = 64 << 10
+)
+
+// errResponseTooLarge is returned when an upstream response exceeds max_response_body_mb.
+var errResponseTooLarge = errors.New("upstream response exceeds the size limit")
+
+// responseReader passes a non-stream response through to the client while
+// keeping enough of it to parse usage. onDone is called once, when the body
+// has been read or closed.
+type responseReader struct {
+	reader    io.ReadCloser
+	ctx       context.Context
+	limit     int64
+	read      int64
+	captured  []byte
+	truncated bool
+	done      bool
+	onDone    func(usage UsageInfo, err error)
+}
+
+func (r *responseReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		r.finish(errResponseTooLarge)
+		return 0, errResponseTooLarge
+	}
+	r.capture(p[:n])
+
+	if err == io.EOF {
+		r.finish(nil)
+	} else if err != nil {
+		err = classifyUpstreamError(r.ctx, err)
+		r.finish(err)
+	}
+	return n, err
+}
+
+func (r *responseReader) capture(p []byte) {
+	r.captured = append(r.captured, p...)
+	if !r.truncated && len(r.captured) <= usageCaptureSize {
+		return
+	}
+	r.truncated = true
+	if len(r.captured) > 2*usageTailSize {
+		r.captured = append(r.captured[:0], r.captured[len(r.captured)-usageTailSize:]...)
+	}
+}
+
+func (r *responseReader) finish(err error) {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	var usage UsageInfo
+	if r.truncated {
+		extractUsageFromTail(r.captured, &usage)
+	} else {
+		extractUsageFromJSON(r.captured, &usage)
+	}
+	r.captured = nil
+	r.onDone(usage, err)
+}
+
+func (r *responseReader) Close() error {
+	if !r.done {
+		// Closed before EOF, e.g. because the client went away
+		r.finish(r.ctx.Err())
+	}
+	return r.reader.Close()
+}
+
+// extractUsageFromTail finds the last usage object in the end of a response
+// too large to parse whole.
+func extractUsageFromTail(tail []byte, usage *UsageInfo) {
+	for _, key := range []string{`"usage"`, `"usageMetadata"`} {
+		idx := bytes.LastIndex(tail, []byte(key))
+		if idx < 0 {
+			continue
+		}
+		rest := bytes.TrimLeft(tail[idx+len(key):], " \t\r\n")
+		if len(rest) == 0 || rest[0] != ':' {
+			continue
+		}
+		var u map[string]interface{}
+		if json.NewDecoder(bytes.NewReader(rest[1:])).Decode(&u) == nil {
+			applyUsage(u, usage)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"bufio"
+	"context"
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/model"
 	"cpa-distribution/service"
 	"encoding/json"
@@ -9,23 +11,90 @@ import (
 	"log"
 	"strings"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 type streamReader struct {
-	reader   io.ReadCloser
-	tokenID  uint
-	userID   uint
-	model    string
-	path     string
-	method   string
-	ip       string
-	status   int
-	duration int
-	usage    UsageInfo
-	done     bool
-	buffer   []byte
-	scanner  *bufio.Scanner
-	inited   bool
+	reader     io.ReadCloser
+	ginCtx     *gin.Context
+	ctx        context.Context
+	tokenID    uint
+	userID     uint
+	channelID  uint
+	model      string
+	upstream   string
+	path       string
+	method     string
+	ip         string
+	status     int
+	attempts   int
+	startTime  time.Time
+	firstToken time.Time
+	usage      UsageInfo
+	done       bool
+	buffer     []byte
+	scanner    *bufio.Scanner
+	inited     bool
+	err        error
+
+	formatKnown bool
+	jsonArray   bool
+	array       jsonArraySplitter
+
+	// hideUsage drops the usage-only chunk of a stream whose client did not
+	// ask for usage; the proxy asked on its behalf
+	hideUsage bool
+	skipLine  bool
+	skipBlank bool
+}
+
+// jsonArraySplitter cuts a streamed JSON array into its elements as lines
+// arrive, without waiting for the closing bracket.
+type jsonArraySplitter struct {
+	depth    int
+	inString bool
+	escaped  bool
+	element  []byte
+}
+
+// feed consumes one line and calls emit with every element it completes.
+func (j *jsonArraySplitter) feed(line string, emit func(string)) {
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		if j.depth >= 2 {
+			j.element = append(j.element, ch)
+		}
+		if j.inString {
+			switch {
+			case j.escaped:
+				j.escaped = false
+			case ch == '\\':
+				j.escaped = true
+			case ch == '"':
+				j.inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			j.inString = true
+		case '{', '[':
+			j.depth++
+			if j.depth == 2 {
+				j.element = append(j.element[:0], ch)
+			}
+		case '}', ']':
+			j.depth--
+			if j.depth == 1 {
+				emit(string(j.element))
+				j.element = j.element[:0]
+			}
+		}
+	}
+	if j.depth >= 2 {
+		j.element = append(j.element, '\n')
+	}
 }
 
 func (s *streamReader) Read(p []byte) (int, error) {
@@ -45,18 +114,24 @@ func (s *streamReader) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
-	if s.scanner.Scan() {
+	for s.scanner.Scan() {
 		line := s.scanner.Text()
+		s.parseLine(line)
+		if s.done {
+			// Record log when stream ends
+			s.recordStreamLog()
+		}
 
-		// Try to extract usage from SSE data
-		if strings.HasPrefix(line, "data: ") {
-			data := strings.TrimPrefix(line, "data: ")
-			if data == "[DONE]" {
-				s.done = true
-				// Record log when stream ends
-				s.recordStreamLog()
-			} else {
-				s.parseStreamChunk(data)
+		// Drop the hidden usage chunk together with the blank line ending its event
+		if s.skipLine {
+			s.skipLine = false
+			s.skipBlank = true
+			continue
+		}
+		if s.skipBlank {
+			s.skipBlank = false
+			if line == "" {
+				continue
 			}
 		}
 
@@ -70,7 +145,8 @@ func (s *streamReader) Read(p []byte) (int, error) {
 	}
 
 	if err := s.scanner.Err(); err != nil {
-		return 0, err
+		s.err = classifyUpstreamError(s.ctx, err)
+		return 0, s.err
 	}
 
 	// EOF - record log if not done yet
@@ -81,24 +157,68 @@ func (s *streamReader) Read(p []byte) (int, error) {
 	return 0, io.EOF
 }
 
+// parseLine extracts usage from one line of the stream. Streams are SSE, except
+// Gemini streamGenerateContent without alt=sse, which sends a JSON array of
+// chunks spread over many lines.
+func (s *streamReader) parseLine(line string) {
+	if !s.formatKnown {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			return
+		}
+		s.formatKnown = true
+		s.jsonArray = strings.HasPrefix(trimmed, "[")
+	}
+
+	if s.jsonArray {
+		s.array.feed(line, s.parseStreamChunk)
+		return
+	}
+
+	if strings.HasPrefix(line, "data: ") {
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			s.done = true
+		} else {
+			s.parseStreamChunk(data)
+		}
+	}
+}
+
 func (s *streamReader) parseStreamChunk(data string) {
 	var chunk map[string]interface{}
 	if json.Unmarshal([]byte(data), &chunk) != nil {
 		return
 	}
 
-	// Extract usage if present (usually in the last chunk)
-	if u, ok := chunk["usage"].(map[string]interface{}); ok {
-		if v, ok := u["prompt_tokens"].(float64); ok {
-			s.usage.PromptTokens = int(v)
+	// Anthropic opens with message_start and may send pings before any content
+	if s.firstToken.IsZero() && chunk["type"] != "message_start" && chunk["type"] != "ping" {
+		s.firstToken = time.Now()
+	}
+
+	// Anthropic sends input usage in message_start and the running output
+	// count in message_delta events
+	if msg, ok := chunk["message"].(map[string]interface{}); ok && chunk["type"] == "message_start" {
+		if u, ok := msg["usage"].(map[string]interface{}); ok {
+			applyUsage(u, &s.usage)
 		}
-		if v, ok := u["completion_tokens"].(float64); ok {
-			s.usage.CompletionTokens = int(v)
+		if s.model == "" {
+			if m, ok := msg["model"].(string); ok {
+				s.model = m
+			}
 		}
-		if v, ok := u["total_tokens"].(float64); ok {
-			s.usage.TotalTokens = int(v)
+	}
+
+	// Extract usage if present (usually in the last chunk)
+	if u, ok := chunk["usage"].(map[string]interface{}); ok {
+		applyUsage(u, &s.usage)
+		if choices, ok := chunk["choices"].([]interface{}); ok && len(choices) == 0 && s.hideUsage {
+			s.skipLine = true
 		}
 	}
+	if u, ok := chunk["usageMetadata"].(map[string]interface{}); ok {
+		applyUsage(u, &s.usage)
+	}
 
 	// Also capture model from chunk if not set
 	if s.model == "" {
@@ -109,27 +229,55 @@ func (s *streamReader) parseStreamChunk(data string) {
 }
 
 func (s *streamReader) recordStreamLog() {
+	metrics.ActiveStreams.Dec()
+
+	// Reported back to RateLimit for TPM accounting
+	s.ginCtx.Set("usage_total_tokens", s.usage.TotalTokens)
+
+	end := time.Now()
+	duration := int(end.Sub(s.startTime).Milliseconds())
+	var firstTokenTime int
+	var tokensPerSecond float64
+	generation := end.Sub(s.startTime)
+	if !s.firstToken.IsZero() {
+		firstTokenTime = int(s.firstToken.Sub(s.startTime).Milliseconds())
+		generation = end.Sub(s.firstToken)
+	}
+	if s.usage.CompletionTokens > 0 && generation > 0 {
+		tokensPerSecond = float64(s.usage.CompletionTokens) / generation.Seconds()
+	}
+
 	logEntry := model.RequestLog{
 		UserID:           s.userID,
 		TokenID:          s.tokenID,
+		ChannelID:        s.channelID,
 		RequestIP:        s.ip,
 		Method:           s.method,
 		Path:             s.path,
 		Model:            s.model,
+		UpstreamModel:    s.upstream,
 		StatusCode:       s.status,
-		Duration:         s.duration,
+		Attempts:         s.attempts,
+		IsStream:         true,
+		Duration:         duration,
+		FirstTokenTime:   firstTokenTime,
+		TokensPerSecond:  tokensPerSecond,
 		PromptTokens:     s.usage.PromptTokens,
 		CompletionTokens: s.usage.CompletionTokens,
 		TotalTokens:      s.usage.TotalTokens,
 		CreatedAt:        time.Now(),
 	}
-	service.RecordLog(logEntry)
-
+	if errorType := errorTypeOf(s.ctx, s.err); errorType != "" {
+		logEntry.ErrorType = errorType
+		logEntry.ErrorMessage = s.err.Error()
+	}
 	if s.status >= 200 && s.status < 300 {
-		service.IncrementUsage(s.tokenID, s.userID)
+		logEntry.Cost = service.CalculateCost(s.model, s.usage.PromptTokens, s.usage.CompletionTokens)
+		service.IncrementUsage(logEntry)
 	}
+	service.RecordLog(logEntry)
 
-	log.Printf("Stream completed: model=%s, tokens=%d, duration=%dms", s.model, s.usage.TotalTokens, s.duration)
+	log.Printf("Stream completed: model=%s, tokens=%d, ttft=%dms, duration=%dms", s.model, s.usage.TotalTokens, firstTokenTime, duration)
 }
 
 func (s *streamReader) Close() error {
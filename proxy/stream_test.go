@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func parseStream(body string) *streamReader {
+	s := &streamReader{}
+	for _, line := range strings.Split(body, "\n") {
+		s.parseLine(line)
+	}
+	return s
+}
+
+// Gemini streamGenerateContent without alt=sse answers with a JSON array whose
+// elements span several lines; usageMetadata is cumulative.
+func TestStreamUsageGeminiJSONArray(t *testing.T) {
+	body := `[{
+  "candidates": [
+    {
+      "content": {
+        "parts": [{"text": "Hello {world} \"[\" "}],
+        "role": "model"
+      }
+    }
+  ],
+  "usageMetadata": {
+    "promptTokenCount": 12,
+    "candidatesTokenCount": 1,
+    "totalTokenCount": 13
+  }
+}
+,
+{
+  "candidates": [
+    {
+      "content": {
+        "parts": [{"text": "!\"}"}],
+        "role": "model"
+      },
+      "finishReason": "STOP"
+    }
+  ],
+  "usageMetadata": {
+    "promptTokenCount": 12,
+    "candidatesTokenCount": 5,
+    "thoughtsTokenCount": 3,
+    "totalTokenCount": 20
+  },
+  "modelVersion": "gemini-2.5-flash"
+}
+]`
+	s := parseStream(body)
+	if s.usage.PromptTokens != 12 || s.usage.CompletionTokens != 8 || s.usage.TotalTokens != 20 {
+		t.Fatalf("usage = %+v; want prompt 12, completion 8, total 20", s.usage)
+	}
+	if s.firstToken.IsZero() {
+		t.Fatal("first token time was not recorded")
+	}
+	if s.done {
+		t.Fatal("JSON array stream marked done before EOF")
+	}
+}
+
+func TestStreamUsageGeminiSSE(t *testing.T) {
+	body := "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"Hi\"}]}}],\"usageMetadata\":{\"promptTokenCount\":4,\"candidatesTokenCount\":1,\"totalTokenCount\":5}}\n" +
+		"\n" +
+		"data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"!\"}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":4,\"candidatesTokenCount\":2,\"totalTokenCount\":6}}\n"
+	s := parseStream(body)
+	if s.usage.PromptTokens != 4 || s.usage.CompletionTokens != 2 || s.usage.TotalTokens != 6 {
+		t.Fatalf("usage = %+v; want prompt 4, completion 2, total 6", s.usage)
+	}
+}
+
+func TestStreamUsageOpenAISSE(t *testing.T) {
+	body := "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+		"data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n" +
+		"data: [DONE]\n"
+	s := parseStream(body)
+	if s.usage.TotalTokens != 10 || s.model != "gpt-4o" || !s.done {
+		t.Fatalf("usage = %+v, model = %q, done = %v", s.usage, s.model, s.done)
+	}
+}
+
+// The usage chunk the proxy asked for on the client's behalf is counted but
+// not passed on; one the client asked for is.
+func TestStreamHiddenUsageChunk(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := "data: {\"model\":\"gpt-4o\",\"choices\":[{\"delta\":{\"content\":\"Hi\"}}],\"usage\":null}\n\n"
+	usage := "data: {\"model\":\"gpt-4o\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n"
+	done := "data: [DONE]\n"
+
+	for _, hide := range []bool{true, false} {
+		ginCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		s := &streamReader{
+			reader:    io.NopCloser(strings.NewReader(content + usage + done)),
+			ginCtx:    ginCtx,
+			status:    500,
+			startTime: time.Now(),
+			hideUsage: hide,
+		}
+		out, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := content + usage + done
+		if hide {
+			want = content + done
+		}
+		if string(out) != want {
+			t.Fatalf("hideUsage %v: output = %q; want %q", hide, out, want)
+		}
+		if s.usage.TotalTokens != 10 {
+			t.Fatalf("hideUsage %v: usage = %+v; want total 10", hide, s.usage)
+		}
+	}
+}
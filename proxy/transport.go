@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"cpa-distribution/common/metrics"
+	"cpa-distribution/model"
+	"cpa-distribution/service"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failoverTransport sends the request to each candidate channel in turn until one
+// answers without a connection error or 5xx. It runs before ReverseProxy writes
+// anything to the client, so failed attempts are invisible to the caller.
+// Channels with an open circuit breaker are skipped. When every channel failed
+// with a connection error or a retryable status, the walk is repeated after a
+// backoff, up to retry_max times. Errors after the request reached an upstream,
+// such as a response header timeout, end the request instead: another attempt
+// could repeat minutes of waiting and bill the work twice.
+type failoverTransport struct {
+	base       http.RoundTripper
+	channels   []model.Channel
+	body       []byte
+	channel    *model.Channel
+	attempts   int
+	retryAfter time.Duration
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := service.GetRetryConfig()
+
+	var lastErr error
+	for round := 0; round <= cfg.MaxRetries; round++ {
+		if round > 0 {
+			delay := max(cfg.Backoff(round), min(t.retryAfter, 10*time.Second))
+			log.Printf("Retrying %s %s in %s (retry %d/%d)", req.Method, req.URL.Path, delay, round, cfg.MaxRetries)
+			metrics.UpstreamRetries.Inc()
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		}
+
+		resp, retry, err := t.tryChannels(req, cfg, round == cfg.MaxRetries)
+		if !retry {
+			t.logOutcome(req, resp, err)
+			return resp, err
+		}
+		lastErr = err
+	}
+	t.logOutcome(req, nil, lastErr)
+	return nil, lastErr
+}
+
+// tryChannels makes one pass over the channels. retry reports whether the pass
+// failed in a way worth repeating; the response of the final attempt is returned
+// instead of being discarded.
+func (t *failoverTransport) tryChannels(req *http.Request, cfg service.RetryConfig, finalRound bool) (*http.Response, bool, error) {
+	var lastErr error
+	attempted := false
+	retryable := false
+	for i := range t.channels {
+		ch := &t.channels[i]
+		lastChannel := i == len(t.channels)-1
+
+		if !service.AllowChannel(ch.ID) {
+			continue
+		}
+		attempted = true
+
+		target, err := url.Parse(ch.BaseURL)
+		if err != nil || target.Host == "" {
+			lastErr = fmt.Errorf("channel %d has invalid base URL", ch.ID)
+			metrics.UpstreamErrors.WithLabelValues(channelLabel(ch.ID), "invalid_url").Inc()
+			log.Printf("Skipping channel %d (%s): invalid base URL", ch.ID, ch.Name)
+			continue
+		}
+		t.channel = ch
+		t.attempts++
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Scheme = target.Scheme
+		outreq.URL.Host = target.Host
+		if basePath := strings.TrimRight(target.Path, "/"); basePath != "" {
+			// Base URLs may mount the API under a path, e.g. https://gateway/openai
+			outreq.URL.Path = basePath + req.URL.Path
+			if req.URL.RawPath != "" {
+				outreq.URL.RawPath = strings.TrimRight(target.EscapedPath(), "/") + req.URL.RawPath
+			}
+		}
+		outreq.Host = target.Host
+		outreq.Header.Set("Authorization", "Bearer "+ch.Key)
+		if outreq.Header.Get("x-api-key") != "" {
+			// Anthropic-style clients authenticate with x-api-key
+			outreq.Header.Set("x-api-key", ch.Key)
+		}
+		if outreq.Header.Get("x-goog-api-key") != "" {
+			outreq.Header.Set("x-goog-api-key", ch.Key)
+		}
+		if query := outreq.URL.Query(); query.Has("key") {
+			// Gemini-style clients may pass the key in the query string
+			query.Set("key", ch.Key)
+			outreq.URL.RawQuery = query.Encode()
+		}
+		if req.Body != nil {
+			outreq.Body = io.NopCloser(bytes.NewReader(t.body))
+			outreq.ContentLength = int64(len(t.body))
+		}
+
+		resp, err := t.base.RoundTrip(outreq)
+		if err != nil {
+			err = classifyUpstreamError(req.Context(), err)
+			lastErr = err
+			if req.Context().Err() != nil {
+				return nil, false, err
+			}
+			reason := "connection"
+			var timeoutErr *UpstreamTimeoutError
+			if errors.As(err, &timeoutErr) {
+				reason = "timeout_" + timeoutErr.Phase
+			}
+			metrics.UpstreamErrors.WithLabelValues(channelLabel(ch.ID), reason).Inc()
+			service.ReportChannelFailure(ch.ID, err.Error())
+			log.Printf("Attempt %d: channel %d (%s) failed: %v", t.attempts, ch.ID, ch.Name, err)
+			if !isConnectError(err) {
+				return nil, false, err
+			}
+			retryable = true
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			metrics.UpstreamErrors.WithLabelValues(channelLabel(ch.ID), "http_"+strconv.Itoa(resp.StatusCode)).Inc()
+			service.ReportChannelFailure(ch.ID, resp.Status)
+		} else {
+			service.ReportChannelSuccess(ch.ID)
+		}
+
+		if cfg.Retryable(resp.StatusCode) && !(finalRound && lastChannel) {
+			retryable = true
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				t.retryAfter = time.Duration(seconds) * time.Second
+			}
+		} else if resp.StatusCode < 500 || lastChannel {
+			return resp, false, nil
+		}
+		log.Printf("Attempt %d: channel %d (%s) returned %d", t.attempts, ch.ID, ch.Name, resp.StatusCode)
+		lastErr = fmt.Errorf("channel %d returned %s", ch.ID, resp.Status)
+		resp.Body.Close()
+	}
+	if !attempted {
+		return nil, false, service.ErrCircuitOpen
+	}
+	return nil, retryable, lastErr
+}
+
+// logOutcome logs the final result of requests that needed more than one attempt.
+func (t *failoverTransport) logOutcome(req *http.Request, resp *http.Response, err error) {
+	if t.attempts <= 1 {
+		return
+	}
+	if resp != nil {
+		log.Printf("%s %s finished after %d attempts: channel %d returned %d", req.Method, req.URL.Path, t.attempts, t.channelID(), resp.StatusCode)
+	} else {
+		log.Printf("%s %s failed after %d attempts: %v", req.Method, req.URL.Path, t.attempts, err)
+	}
+}
+
+// channelID returns the ID of the channel that served (or last failed) the request.
+func (t *failoverTransport) channelID() uint {
+	if t.channel == nil {
+		return 0
+	}
+	return t.channel.ID
+}
+
+func channelLabel(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -6,10 +6,13 @@ import (
 	"cpa-distribution/proxy"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func SetupRouter() *gin.Engine {
-	r := gin.Default()
+	// gin.Default's logger would print Gemini-style ?key= API keys verbatim
+	r := gin.New()
+	r.Use(middleware.AccessLogger(), gin.Recovery())
 
 	r.Use(middleware.CORS())
 
@@ -18,6 +21,9 @@ func SetupRouter() *gin.Engine {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Prometheus metrics
+	r.GET("/metrics", middleware.MetricsAuth(), gin.WrapH(promhttp.Handler()))
+
 	// OAuth routes (no auth required)
 	oauth := r.Group("/api/oauth")
 	{
@@ -45,9 +51,11 @@ func SetupRouter() *gin.Engine {
 		// Logs
 		api.GET("/logs", controller.ListUserLogs)
 		api.GET("/logs/stats", controller.GetUserLogStats)
+		api.GET("/logs/export", controller.ExportUserLogs)
 
 		// Dashboard
 		api.GET("/dashboard", controller.GetDashboard)
+		api.GET("/analytics", controller.GetAnalytics)
 	}
 
 	// Admin API routes (require JWT + admin role)
@@ -56,16 +64,38 @@ func SetupRouter() *gin.Engine {
 		// User management
 		admin.GET("/users", controller.AdminListUsers)
 		admin.PUT("/users/:id", controller.AdminUpdateUser)
+		admin.GET("/quota-history", controller.AdminListQuotaHistory)
 
 		// IP bans
 		admin.GET("/ip-bans", controller.ListIPBans)
 		admin.POST("/ip-bans", controller.CreateIPBan)
 		admin.DELETE("/ip-bans/:id", controller.DeleteIPBan)
 
+		// Upstream channels
+		admin.GET("/channels", controller.ListChannels)
+		admin.POST("/channels", controller.CreateChannel)
+		admin.PUT("/channels/:id", controller.UpdateChannel)
+		admin.DELETE("/channels/:id", controller.DeleteChannel)
+		admin.GET("/upstream/status", controller.GetUpstreamStatus)
+
+		// Model pricing
+		admin.GET("/model-prices", controller.ListModelPrices)
+		admin.POST("/model-prices", controller.CreateModelPrice)
+		admin.PUT("/model-prices/:id", controller.UpdateModelPrice)
+		admin.DELETE("/model-prices/:id", controller.DeleteModelPrice)
+
+		// Model name mapping
+		admin.GET("/model-mappings", controller.ListModelMappings)
+		admin.POST("/model-mappings", controller.CreateModelMapping)
+		admin.PUT("/model-mappings/:id", controller.UpdateModelMapping)
+		admin.DELETE("/model-mappings/:id", controller.DeleteModelMapping)
+
 		// Global logs
 		admin.GET("/logs", controller.AdminListLogs)
 		admin.GET("/logs/stats", controller.AdminGetLogStats)
+		admin.GET("/logs/export", controller.AdminExportLogs)
 		admin.DELETE("/logs", controller.AdminCleanLogs)
+		admin.GET("/analytics", controller.AdminGetAnalytics)
 
 		// System settings
 		admin.GET("/settings", controller.GetSettings)
@@ -73,16 +103,25 @@ func SetupRouter() *gin.Engine {
 	}
 
 	// Proxy routes (API key auth with full middleware chain)
-	proxyGroup := r.Group("/v1")
-	proxyGroup.Use(
+	proxyMiddleware := []gin.HandlerFunc{
 		middleware.IPCheck(),
 		middleware.RequestLogger(),
 		middleware.TokenAuth(),
 		middleware.RateLimit(),
-	)
+	}
+
+	proxyGroup := r.Group("/v1")
+	proxyGroup.Use(proxyMiddleware...)
 	{
 		proxyGroup.Any("/*path", proxy.ProxyHandler)
 	}
 
+	// Gemini-style routes (/v1beta/models/{model}:generateContent)
+	geminiGroup := r.Group("/v1beta")
+	geminiGroup.Use(proxyMiddleware...)
+	{
+		geminiGroup.Any("/*path", proxy.ProxyHandler)
+	}
+
 	return r
 }
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"cpa-distribution/model"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	priceCache map[string]model.ModelPrice
+	priceMutex sync.RWMutex
+)
+
+func InitPriceCache() {
+	RefreshPriceCache()
+	go func() {
+		ticker := time.NewTicker(60 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			RefreshPriceCache()
+		}
+	}()
+}
+
+func RefreshPriceCache() {
+	prices, err := model.GetAllModelPrices()
+	if err != nil {
+		log.Printf("Failed to refresh model price cache: %v", err)
+		return
+	}
+
+	cache := make(map[string]model.ModelPrice, len(prices))
+	for _, p := range prices {
+		cache[p.Model] = p
+	}
+
+	priceMutex.Lock()
+	priceCache = cache
+	priceMutex.Unlock()
+}
+
+// CalculateCost returns the cost of a successful call to modelName. Models
+// without a price entry are free.
+func CalculateCost(modelName string, promptTokens int, completionTokens int) float64 {
+	priceMutex.RLock()
+	price, exists := priceCache[modelName]
+	priceMutex.RUnlock()
+	if !exists {
+		return 0
+	}
+
+	return price.PerCallPrice +
+		price.InputPrice*float64(promptTokens)/1000 +
+		price.OutputPrice*float64(completionTokens)/1000
+}
+
+// isPricedModel reports whether modelName has a price entry.
+func isPricedModel(modelName string) bool {
+	priceMutex.RLock()
+	defer priceMutex.RUnlock()
+	_, exists := priceCache[modelName]
+	return exists
+}
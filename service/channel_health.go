@@ -0,0 +1,230 @@
+package service
+
+import (
+	"context"
+	"cpa-distribution/model"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is returned when every candidate channel has an open breaker.
+var ErrCircuitOpen = errors.New("circuit breaker open for all upstream channels")
+
+// ChannelHealth is the health and breaker state of one channel as shown to admins.
+type ChannelHealth struct {
+	ChannelID           uint       `json:"channel_id"`
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error"`
+	LastFailureAt       *time.Time `json:"last_failure_at"`
+	OpenedAt            *time.Time `json:"opened_at"`
+	LastProbeAt         *time.Time `json:"last_probe_at"`
+	LastProbeOK         bool       `json:"last_probe_ok"`
+	LastProbeLatency    int        `json:"last_probe_latency"`
+}
+
+// HealthConfig holds the health check and breaker settings. A zero interval
+// disables probes and a zero threshold disables the breaker.
+type HealthConfig struct {
+	Interval         int    `json:"health_check_interval"`
+	Path             string `json:"health_check_path"`
+	FailureThreshold int    `json:"breaker_failure_threshold"`
+	Cooldown         int    `json:"breaker_cooldown"`
+}
+
+func GetHealthConfig() HealthConfig {
+	cfg := HealthConfig{
+		Interval:         model.GetSettingInt("health_check_interval", 60),
+		Path:             model.GetSetting("health_check_path"),
+		FailureThreshold: model.GetSettingInt("breaker_failure_threshold", 5),
+		Cooldown:         model.GetSettingInt("breaker_cooldown", 30),
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/v1/models"
+	}
+	return cfg
+}
+
+type channelBreaker struct {
+	health    ChannelHealth
+	trialFrom time.Time
+}
+
+var (
+	breakers     = make(map[uint]*channelBreaker)
+	breakerMutex sync.Mutex
+)
+
+func InitChannelHealth() {
+	go func() {
+		for {
+			interval := GetHealthConfig().Interval
+			if interval > 0 {
+				probeChannels()
+			} else {
+				interval = 60
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
+}
+
+func breakerCooldown() time.Duration {
+	return time.Duration(GetHealthConfig().Cooldown) * time.Second
+}
+
+func getBreaker(id uint) *channelBreaker {
+	b, exists := breakers[id]
+	if !exists {
+		b = &channelBreaker{health: ChannelHealth{ChannelID: id, State: BreakerClosed}}
+		breakers[id] = b
+	}
+	return b
+}
+
+// AllowChannel reports whether a request may be sent to the channel. Once the
+// cooldown of an open breaker has passed, a single trial request is let through
+// in the half-open state.
+func AllowChannel(id uint) bool {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b := getBreaker(id)
+	now := time.Now()
+	switch b.health.State {
+	case BreakerOpen:
+		if now.Sub(*b.health.OpenedAt) < breakerCooldown() {
+			return false
+		}
+		b.health.State = BreakerHalfOpen
+		b.trialFrom = now
+		return true
+	case BreakerHalfOpen:
+		// A trial that never reported back must not keep the channel shut
+		if now.Sub(b.trialFrom) < breakerCooldown() {
+			return false
+		}
+		b.trialFrom = now
+		return true
+	}
+	return true
+}
+
+// ReportChannelSuccess closes the channel's breaker.
+func ReportChannelSuccess(id uint) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b := getBreaker(id)
+	if b.health.State != BreakerClosed {
+		log.Printf("Circuit breaker for channel %d closed", id)
+	}
+	b.health.State = BreakerClosed
+	b.health.ConsecutiveFailures = 0
+	b.health.OpenedAt = nil
+}
+
+// ReportChannelFailure counts a failed request and opens the breaker after
+// breaker_failure_threshold consecutive failures. A failure while the breaker is
+// not closed (a failed trial or probe) restarts the cooldown.
+func ReportChannelFailure(id uint, reason string) {
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	b := getBreaker(id)
+	now := time.Now()
+	b.health.ConsecutiveFailures++
+	b.health.LastError = reason
+	b.health.LastFailureAt = &now
+
+	if b.health.State == BreakerClosed {
+		threshold := GetHealthConfig().FailureThreshold
+		if threshold <= 0 || b.health.ConsecutiveFailures < threshold {
+			return
+		}
+		log.Printf("Circuit breaker for channel %d opened after %d failures: %s", id, b.health.ConsecutiveFailures, reason)
+	}
+	b.health.State = BreakerOpen
+	b.health.OpenedAt = &now
+}
+
+// GetChannelHealth returns the health of every channel requests can be routed to.
+func GetChannelHealth() []ChannelHealth {
+	channels := SelectChannels()
+
+	breakerMutex.Lock()
+	defer breakerMutex.Unlock()
+
+	result := make([]ChannelHealth, 0, len(channels))
+	for _, ch := range channels {
+		health := getBreaker(ch.ID).health
+		health.Name = ch.Name
+		result = append(result, health)
+	}
+	return result
+}
+
+func probeChannels() {
+	var wg sync.WaitGroup
+	for _, ch := range SelectChannels() {
+		wg.Add(1)
+		go func(ch model.Channel) {
+			defer wg.Done()
+			probeChannel(ch)
+		}(ch)
+	}
+	wg.Wait()
+}
+
+// probeChannel sends the configured lightweight request to a channel. A failed
+// probe counts like a failed request; a successful one closes an open breaker
+// whose cooldown has passed.
+func probeChannel(ch model.Channel) {
+	path := GetHealthConfig().Path
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	var probeErr error
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(ch.BaseURL, "/")+path, nil)
+	if err != nil {
+		probeErr = err
+	} else {
+		req.Header.Set("Authorization", "Bearer "+ch.Key)
+		resp, err := (&http.Client{Transport: UpstreamTransport()}).Do(req)
+		if err != nil {
+			probeErr = err
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				probeErr = errors.New(resp.Status)
+			}
+		}
+	}
+
+	breakerMutex.Lock()
+	b := getBreaker(ch.ID)
+	b.health.LastProbeAt = &start
+	b.health.LastProbeOK = probeErr == nil
+	b.health.LastProbeLatency = int(time.Since(start).Milliseconds())
+	recovering := b.health.State != BreakerClosed && b.health.OpenedAt != nil && time.Since(*b.health.OpenedAt) >= breakerCooldown()
+	breakerMutex.Unlock()
+
+	if probeErr != nil {
+		ReportChannelFailure(ch.ID, "health check: "+probeErr.Error())
+	} else if recovering {
+		ReportChannelSuccess(ch.ID)
+	}
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"cpa-distribution/common"
+	"cpa-distribution/model"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+var (
+	channelCache []model.Channel
+	channelMutex sync.RWMutex
+)
+
+func InitChannelCache() {
+	RefreshChannelCache()
+	go func() {
+		ticker := time.NewTicker(60 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			RefreshChannelCache()
+		}
+	}()
+}
+
+func RefreshChannelCache() {
+	channels, err := model.GetEnabledChannels()
+	if err != nil {
+		log.Printf("Failed to refresh channel cache: %v", err)
+		return
+	}
+
+	channelMutex.Lock()
+	channelCache = channels
+	channelMutex.Unlock()
+}
+
+// SelectChannels returns the enabled channels in the order they should be tried:
+// higher priority first, weighted random order within the same priority.
+// When no channel is configured, the legacy cpa_upstream_url/cpa_upstream_key
+// settings are used as a single channel with ID 0.
+func SelectChannels() []model.Channel {
+	channelMutex.RLock()
+	channels := make([]model.Channel, len(channelCache))
+	copy(channels, channelCache)
+	channelMutex.RUnlock()
+
+	if len(channels) == 0 {
+		if legacy := legacyChannel(); legacy != nil {
+			return []model.Channel{*legacy}
+		}
+		return nil
+	}
+
+	// channelCache is already ordered by priority desc
+	ordered := make([]model.Channel, 0, len(channels))
+	for i := 0; i < len(channels); {
+		j := i
+		for j < len(channels) && channels[j].Priority == channels[i].Priority {
+			j++
+		}
+		ordered = append(ordered, weightedShuffle(channels[i:j])...)
+		i = j
+	}
+	return ordered
+}
+
+func weightedShuffle(group []model.Channel) []model.Channel {
+	remaining := append([]model.Channel(nil), group...)
+	result := make([]model.Channel, 0, len(group))
+	for len(remaining) > 0 {
+		total := 0
+		for _, ch := range remaining {
+			total += channelWeight(ch)
+		}
+
+		pick := rand.IntN(total)
+		idx := 0
+		for i, ch := range remaining {
+			pick -= channelWeight(ch)
+			if pick < 0 {
+				idx = i
+				break
+			}
+		}
+
+		result = append(result, remaining[idx])
+		remaining = append(remaining[:idx], remaining[idx+1:]...)
+	}
+	return result
+}
+
+func channelWeight(ch model.Channel) int {
+	if ch.Weight <= 0 {
+		return 1
+	}
+	return ch.Weight
+}
+
+func legacyChannel() *model.Channel {
+	upstreamURL := common.CPAUpstreamURL
+	upstreamKey := common.CPAUpstreamKey
+
+	// Allow override from system settings
+	if settingURL := model.GetSetting("cpa_upstream_url"); settingURL != "" {
+		upstreamURL = settingURL
+	}
+	if settingKey := model.GetSetting("cpa_upstream_key"); settingKey != "" {
+		upstreamKey = settingKey
+	}
+
+	if upstreamURL == "" || upstreamKey == "" {
+		return nil
+	}
+	return &model.Channel{
+		Name:    "default",
+		BaseURL: upstreamURL,
+		Key:     upstreamKey,
+		Weight:  1,
+		Status:  common.StatusEnabled,
+	}
+}
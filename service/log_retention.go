@@ -0,0 +1,67 @@
+package service
+
+import (
+	"cpa-distribution/model"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	retentionChunkSize  = 1000
+	retentionChunkPause = 100 * time.Millisecond
+	retentionInterval   = time.Hour
+)
+
+// retentionMutex keeps the scheduled job and manual cleanups from overlapping.
+var retentionMutex sync.Mutex
+
+// InitLogRetention deletes logs older than log_retention_days every hour.
+// Unset or 0 keeps logs forever.
+func InitLogRetention() {
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			if days := model.GetSettingInt("log_retention_days", 0); days > 0 {
+				deleted, err := CleanupOldLogs(days)
+				if err != nil {
+					log.Printf("Log retention failed after deleting %d logs: %v", deleted, err)
+				} else if deleted > 0 {
+					log.Printf("Log retention deleted %d logs older than %d days", deleted, days)
+				}
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// CleanupOldLogs deletes logs older than days in chunks, pausing between
+// chunks so other writers are not locked out, and records the run in
+// log_retention_last_run and log_retention_last_deleted. Daily totals of the
+// deleted logs remain in the usage rollup.
+func CleanupOldLogs(days int) (int64, error) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	var total int64
+	var err error
+	for {
+		var deleted int64
+		deleted, err = model.DeleteLogsChunk(cutoff, retentionChunkSize)
+		total += deleted
+		if err != nil || deleted < retentionChunkSize {
+			break
+		}
+		time.Sleep(retentionChunkPause)
+	}
+
+	model.BatchSetSettings(map[string]string{
+		"log_retention_last_run":     strconv.FormatInt(time.Now().Unix(), 10),
+		"log_retention_last_deleted": strconv.FormatInt(total, 10),
+	})
+	return total, err
+}
@@ -1,27 +1,77 @@
 package service
 
 import (
+	"cpa-distribution/common/metrics"
 	"cpa-distribution/model"
 	"log"
+	"strconv"
 	"time"
 )
 
-var logChannel chan model.RequestLog
+var (
+	logChannel chan model.RequestLog
+	logStop    chan struct{}
+	logDone    chan struct{}
+)
 
 func InitLogService() {
 	logChannel = make(chan model.RequestLog, 1000)
+	logStop = make(chan struct{})
+	logDone = make(chan struct{})
 	go logConsumer()
+
+	metrics.RegisterGaugeFunc("cpa_log_queue_depth", "Log entries waiting to be written to the database.", func() float64 {
+		return float64(len(logChannel))
+	})
+}
+
+// StopLogService stops the spool replay and writes all queued and buffered
+// logs to the database. It should be called once the server no longer accepts
+// requests.
+func StopLogService() {
+	stopLogSpool()
+	close(logStop)
+	<-logDone
 }
 
 func RecordLog(logEntry model.RequestLog) {
+	observeRequest(logEntry)
+
 	select {
 	case logChannel <- logEntry:
 	default:
-		log.Println("Log channel full, dropping log entry")
+		spoolLogs([]model.RequestLog{logEntry})
+	}
+}
+
+// observeRequest feeds a finished proxy request into the Prometheus metrics.
+func observeRequest(entry model.RequestLog) {
+	modelLabel := metricsModelLabel(entry.Model)
+	status := strconv.Itoa(entry.StatusCode)
+	channel := strconv.FormatUint(uint64(entry.ChannelID), 10)
+	metrics.Requests.WithLabelValues(modelLabel, status, channel).Inc()
+	metrics.RequestDuration.WithLabelValues(modelLabel, status, channel).Observe(float64(entry.Duration) / 1000)
+	if entry.PromptTokens > 0 {
+		metrics.Tokens.WithLabelValues(modelLabel, "prompt").Add(float64(entry.PromptTokens))
 	}
+	if entry.CompletionTokens > 0 {
+		metrics.Tokens.WithLabelValues(modelLabel, "completion").Add(float64(entry.CompletionTokens))
+	}
+}
+
+// metricsModelLabel returns the model label for a request. The model name comes
+// from the client, so only models the admin configured (priced or mapped) get
+// their own series; anything else is counted as "other" to bound cardinality.
+func metricsModelLabel(name string) string {
+	if name != "" && (isPricedModel(name) || isMappedModel(name)) {
+		return name
+	}
+	return "other"
 }
 
 func logConsumer() {
+	defer close(logDone)
+
 	buffer := make([]model.RequestLog, 0, 50)
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -39,16 +89,25 @@ func logConsumer() {
 				flushLogs(buffer)
 				buffer = make([]model.RequestLog, 0, 50)
 			}
+		case <-logStop:
+			for {
+				select {
+				case entry := <-logChannel:
+					buffer = append(buffer, entry)
+				default:
+					if len(buffer) > 0 {
+						flushLogs(buffer)
+					}
+					return
+				}
+			}
 		}
 	}
 }
 
 func flushLogs(logs []model.RequestLog) {
 	if err := model.BatchInsertLogs(logs); err != nil {
-		log.Printf("Failed to flush %d logs: %v", len(logs), err)
+		log.Printf("Failed to flush %d logs, spooling: %v", len(logs), err)
+		spoolLogs(logs)
 	}
 }
-
-func CleanupOldLogs(days int) (int64, error) {
-	return model.DeleteLogsBeforeDays(days)
-}
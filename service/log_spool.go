@@ -0,0 +1,234 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"cpa-distribution/common"
+	"cpa-distribution/common/metrics"
+	"cpa-distribution/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logs that cannot be queued or inserted are appended to a JSON lines spool file
+// and replayed into the database later, since usage is billed from them.
+var (
+	spoolMutex sync.Mutex
+	spoolDepth atomic.Int64
+	spoolStop  chan struct{}
+	spoolDone  chan struct{}
+)
+
+func InitLogSpool() {
+	if err := os.MkdirAll(filepath.Dir(common.LogSpoolPath), 0755); err != nil {
+		log.Printf("Failed to create log spool directory: %v", err)
+	}
+	spoolDepth.Store(countSpoolLines(common.LogSpoolPath) + countSpoolLines(replayPath()))
+	metrics.RegisterGaugeFunc("cpa_log_spool_depth", "Log entries waiting in the spool file.", func() float64 {
+		return float64(LogSpoolDepth())
+	})
+
+	spoolStop = make(chan struct{})
+	spoolDone = make(chan struct{})
+	go func() {
+		defer close(spoolDone)
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			replaySpool()
+			select {
+			case <-ticker.C:
+			case <-spoolStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopLogSpool stops the replay loop and waits for a replay in progress, so
+// the database can be closed after it.
+func stopLogSpool() {
+	if spoolStop == nil {
+		return
+	}
+	close(spoolStop)
+	<-spoolDone
+	spoolStop = nil
+}
+
+// LogSpoolDepth returns the number of log entries waiting in the spool.
+func LogSpoolDepth() int64 {
+	return spoolDepth.Load()
+}
+
+func spoolLogs(logs []model.RequestLog) {
+	spoolMutex.Lock()
+	defer spoolMutex.Unlock()
+
+	f, err := os.OpenFile(common.LogSpoolPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open log spool, dropping %d logs: %v", len(logs), err)
+		metrics.LogsDropped.Add(float64(len(logs)))
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	written := 0
+	for _, entry := range logs {
+		// A failed batch insert may have assigned IDs that were rolled back
+		entry.ID = 0
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = time.Now()
+		}
+		if err := enc.Encode(&entry); err != nil {
+			log.Printf("Failed to encode spooled log: %v", err)
+			metrics.LogsDropped.Inc()
+			continue
+		}
+		written++
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("Failed to write log spool, dropping %d logs: %v", written, err)
+		metrics.LogsDropped.Add(float64(written))
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("Failed to sync log spool: %v", err)
+	}
+	spoolDepth.Add(int64(written))
+	metrics.LogsSpooled.Add(float64(written))
+}
+
+func replayPath() string {
+	return common.LogSpoolPath + ".replay"
+}
+
+// maxSpoolLine is the longest spooled entry that is replayed; longer lines
+// cannot be a log written by spoolLogs and are dropped.
+const maxSpoolLine = 1 << 20
+
+// replaySpool moves the spool aside and inserts its entries. Entries that still
+// cannot be inserted go back into the spool. Unreadable lines are dropped; if
+// the file itself cannot be read to the end, the unread rest is moved to a
+// .corrupt file, since the batches inserted so far must not be replayed again.
+func replaySpool() {
+	path := replayPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		spoolMutex.Lock()
+		err := os.Rename(common.LogSpoolPath, path)
+		spoolMutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open log spool for replay: %v", err)
+		return
+	}
+
+	var logs []model.RequestLog
+	var failed []model.RequestLog
+	total := 0
+	readErr := eachSpoolLine(f, func(line []byte) {
+		total++
+		var entry model.RequestLog
+		if line == nil {
+			log.Printf("Dropping spooled log longer than %d bytes", maxSpoolLine)
+			metrics.LogsDropped.Inc()
+			return
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping malformed spooled log: %v", err)
+			metrics.LogsDropped.Inc()
+			return
+		}
+		logs = append(logs, entry)
+		if len(logs) >= 100 {
+			if err := model.BatchInsertLogs(logs); err != nil {
+				failed = append(failed, logs...)
+			}
+			logs = nil
+		}
+	})
+	f.Close()
+	if len(logs) > 0 {
+		if err := model.BatchInsertLogs(logs); err != nil {
+			failed = append(failed, logs...)
+		}
+	}
+
+	if readErr != nil {
+		corrupt := fmt.Sprintf("%s.%d.corrupt", path, time.Now().Unix())
+		log.Printf("Failed to read log spool after %d entries, moving it to %s: %v", total, corrupt, readErr)
+		err = os.Rename(path, corrupt)
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		// Keeping the file would replay the inserted entries again
+		log.Printf("Failed to remove replayed log spool, truncating it: %v", err)
+		if err := os.Truncate(path, 0); err != nil {
+			log.Printf("Failed to truncate replayed log spool: %v", err)
+		}
+	}
+	spoolMutex.Lock()
+	spoolDepth.Store(countSpoolLines(common.LogSpoolPath))
+	spoolMutex.Unlock()
+	if len(failed) > 0 {
+		spoolLogs(failed)
+	}
+	if replayed := total - len(failed); replayed > 0 {
+		log.Printf("Replayed %d spooled logs", replayed)
+	}
+}
+
+// eachSpoolLine calls fn with every line of r, without the newline. Lines
+// longer than maxSpoolLine are skipped and reported as nil.
+func eachSpoolLine(r io.Reader, fn func(line []byte)) error {
+	reader := bufio.NewReaderSize(r, maxSpoolLine)
+	tooLong := false
+	for {
+		line, err := reader.ReadSlice('\n')
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			tooLong = true
+			continue
+		case tooLong:
+			// The remainder of an oversized line
+			tooLong = false
+			fn(nil)
+		case len(bytes.TrimSpace(line)) > 0:
+			fn(bytes.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func countSpoolLines(path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var count int64
+	eachSpoolLine(f, func([]byte) { count++ })
+	return count
+}
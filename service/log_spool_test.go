@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"cpa-distribution/common"
+	"cpa-distribution/model"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/logger"
+)
+
+func setupSpoolTest(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	common.LogSpoolPath = filepath.Join("data", "log_spool.jsonl")
+	model.InitDB()
+	model.DB.Logger = logger.Discard
+	t.Cleanup(model.CloseDB)
+}
+
+func writeSpool(t *testing.T, lines ...[]byte) {
+	t.Helper()
+	if err := os.WriteFile(common.LogSpoolPath, append(bytes.Join(lines, []byte("\n")), '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spooledLog(t *testing.T, i int) []byte {
+	t.Helper()
+	line, err := json.Marshal(model.RequestLog{UserID: 1, Model: "m", StatusCode: 200, TotalTokens: i, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func countRows(t *testing.T) (logs int64, usage int64) {
+	t.Helper()
+	model.DB.Model(&model.RequestLog{}).Count(&logs)
+	model.DB.Model(&model.UsageDaily{}).Select("COALESCE(SUM(requests), 0)").Scan(&usage)
+	return logs, usage
+}
+
+// An oversized line used to stop the scan after some batches were committed,
+// leaving the replay file behind to be inserted again on every tick.
+func TestReplaySpoolOversizedLine(t *testing.T) {
+	setupSpoolTest(t)
+
+	var lines [][]byte
+	for i := 0; i < 150; i++ {
+		lines = append(lines, spooledLog(t, i))
+	}
+	lines = append(lines, []byte(`{"model":"`+strings.Repeat("x", 2*maxSpoolLine)+`"}`))
+	for i := 0; i < 10; i++ {
+		lines = append(lines, spooledLog(t, i))
+	}
+	lines = append(lines, []byte(`{"user_id":1,"mod`))
+	writeSpool(t, lines...)
+
+	replaySpool()
+	if logs, usage := countRows(t); logs != 160 || usage != 160 {
+		t.Fatalf("after replay: %d logs, %d rolled up requests; want 160", logs, usage)
+	}
+	if _, err := os.Stat(replayPath()); !os.IsNotExist(err) {
+		t.Fatalf("replay file still exists: %v", err)
+	}
+	if depth := LogSpoolDepth(); depth != 0 {
+		t.Fatalf("spool depth = %d; want 0", depth)
+	}
+
+	replaySpool()
+	if logs, usage := countRows(t); logs != 160 || usage != 160 {
+		t.Fatalf("after second replay: %d logs, %d rolled up requests; want 160", logs, usage)
+	}
+}
+
+func TestEachSpoolLine(t *testing.T) {
+	input := "a\n\n" + strings.Repeat("x", maxSpoolLine+10) + "\nb\r\nc"
+	var got []string
+	if err := eachSpoolLine(strings.NewReader(input), func(line []byte) {
+		if line == nil {
+			got = append(got, "<too long>")
+		} else {
+			got = append(got, string(line))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "<too long>", "b", "c"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("lines = %q; want %q", got, want)
+	}
+}
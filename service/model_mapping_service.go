@@ -0,0 +1,116 @@
+package service
+
+import (
+	"cpa-distribution/model"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	exactMappings    map[string]string
+	wildcardMappings []model.ModelMapping
+	mappingMutex     sync.RWMutex
+)
+
+func InitModelMappingCache() {
+	RefreshModelMappingCache()
+	go func() {
+		ticker := time.NewTicker(60 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			RefreshModelMappingCache()
+		}
+	}()
+}
+
+func RefreshModelMappingCache() {
+	mappings, err := model.GetAllModelMappings()
+	if err != nil {
+		log.Printf("Failed to refresh model mapping cache: %v", err)
+		return
+	}
+
+	exact := make(map[string]string)
+	var wildcards []model.ModelMapping
+	for _, m := range mappings {
+		if strings.Contains(m.Pattern, "*") {
+			wildcards = append(wildcards, m)
+		} else {
+			exact[m.Pattern] = m.Target
+		}
+	}
+	// Most specific (longest) wildcard pattern wins
+	sort.SliceStable(wildcards, func(i, j int) bool {
+		return len(wildcards[i].Pattern) > len(wildcards[j].Pattern)
+	})
+
+	mappingMutex.Lock()
+	exactMappings = exact
+	wildcardMappings = wildcards
+	mappingMutex.Unlock()
+}
+
+// MapModel returns the upstream model name for a requested one. Exact mappings
+// take precedence over wildcard patterns; unmapped names are returned unchanged.
+func MapModel(name string) string {
+	if name == "" {
+		return name
+	}
+
+	mappingMutex.RLock()
+	defer mappingMutex.RUnlock()
+
+	if target, exists := exactMappings[name]; exists {
+		return target
+	}
+	for _, m := range wildcardMappings {
+		if matched, ok := matchWildcard(m.Pattern, name); ok {
+			return strings.Replace(m.Target, "*", matched, 1)
+		}
+	}
+	return name
+}
+
+// ModelAliases returns the model names that exact mappings make available.
+func ModelAliases() []string {
+	mappingMutex.RLock()
+	defer mappingMutex.RUnlock()
+
+	aliases := make([]string, 0, len(exactMappings))
+	for alias := range exactMappings {
+		aliases = append(aliases, alias)
+	}
+	return aliases
+}
+
+// isMappedModel reports whether name is the alias or target of an exact mapping.
+func isMappedModel(name string) bool {
+	mappingMutex.RLock()
+	defer mappingMutex.RUnlock()
+
+	if _, exists := exactMappings[name]; exists {
+		return true
+	}
+	for _, target := range exactMappings {
+		if target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard matches name against a pattern containing one "*" and returns
+// the substring the wildcard covered.
+func matchWildcard(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
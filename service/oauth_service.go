@@ -145,6 +145,16 @@ func HandleOAuthCallback(code string, clientIP string) (string, error) {
 			}
 		}
 
+		// Check default balance from settings
+		defaultBalanceStr := model.GetSetting("default_balance")
+		if defaultBalanceStr != "" {
+			var balance float64
+			fmt.Sscanf(defaultBalanceStr, "%f", &balance)
+			if balance > 0 {
+				user.Balance = balance
+			}
+		}
+
 		if err := user.Insert(); err != nil {
 			return "", fmt.Errorf("create user failed: %w", err)
 		}
@@ -157,7 +167,7 @@ func HandleOAuthCallback(code string, clientIP string) (string, error) {
 		now := time.Now().Unix()
 		user.LastLoginAt = &now
 		user.LastLoginIP = clientIP
-		if err := user.Update(); err != nil {
+		if err := user.Update("username", "display_name", "avatar_url", "trust_level", "last_login_at", "last_login_ip"); err != nil {
 			return "", fmt.Errorf("update user failed: %w", err)
 		}
 	}
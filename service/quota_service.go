@@ -0,0 +1,127 @@
+package service
+
+import (
+	"cpa-distribution/common"
+	"cpa-distribution/model"
+	"fmt"
+	"log"
+	"time"
+)
+
+func InitQuotaScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			resetDueQuotas()
+			<-ticker.C
+		}
+	}()
+}
+
+// ValidateQuotaPeriod checks a period/timezone pair coming from an API request.
+func ValidateQuotaPeriod(period string, timezone string) error {
+	switch period {
+	case "", common.QuotaPeriodNone, common.QuotaPeriodDaily, common.QuotaPeriodWeekly, common.QuotaPeriodMonthly:
+	default:
+		return fmt.Errorf("无效的配额周期: %s", period)
+	}
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("无效的时区: %s", timezone)
+		}
+	}
+	return nil
+}
+
+// NextQuotaReset returns the Unix time of the first period boundary after now,
+// or nil when the period does not reset.
+func NextQuotaReset(period string, timezone string, now time.Time) *int64 {
+	loc := quotaLocation(timezone)
+	local := now.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var next time.Time
+	switch period {
+	case common.QuotaPeriodDaily:
+		next = day.AddDate(0, 0, 1)
+	case common.QuotaPeriodWeekly:
+		// Weeks start on Monday
+		daysUntilMonday := (8 - int(day.Weekday())) % 7
+		if daysUntilMonday == 0 {
+			daysUntilMonday = 7
+		}
+		next = day.AddDate(0, 0, daysUntilMonday)
+	case common.QuotaPeriodMonthly:
+		next = time.Date(local.Year(), local.Month()+1, 1, 0, 0, 0, 0, loc)
+	default:
+		return nil
+	}
+
+	resetAt := next.Unix()
+	return &resetAt
+}
+
+func quotaLocation(timezone string) *time.Location {
+	if timezone != "" {
+		if loc, err := time.LoadLocation(timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// previousBoundary steps back one period from end to find where it started.
+func previousBoundary(period string, timezone string, end time.Time) time.Time {
+	local := end.In(quotaLocation(timezone))
+	switch period {
+	case common.QuotaPeriodDaily:
+		return local.AddDate(0, 0, -1)
+	case common.QuotaPeriodWeekly:
+		return local.AddDate(0, 0, -7)
+	case common.QuotaPeriodMonthly:
+		return local.AddDate(0, -1, 0)
+	}
+	return local
+}
+
+func resetDueQuotas() {
+	now := time.Now()
+
+	users, err := model.GetUsersDueForQuotaReset(now.Unix())
+	if err != nil {
+		log.Printf("Failed to query users due for quota reset: %v", err)
+	}
+	for _, u := range users {
+		resetQuota(&model.User{}, "user", u.ID, u.QuotaPeriod, u.QuotaTimezone, u.QuotaTotal, u.QuotaUsed, *u.QuotaResetAt, now)
+	}
+
+	tokens, err := model.GetTokensDueForQuotaReset(now.Unix())
+	if err != nil {
+		log.Printf("Failed to query tokens due for quota reset: %v", err)
+	}
+	for _, t := range tokens {
+		resetQuota(&model.Token{}, "token", t.ID, t.QuotaPeriod, t.QuotaTimezone, t.QuotaTotal, t.QuotaUsed, *t.QuotaResetAt, now)
+	}
+}
+
+func resetQuota(table interface{}, subjectType string, id uint, period string, timezone string, quotaTotal int64, quotaUsed int64, resetAt int64, now time.Time) {
+	next := NextQuotaReset(period, timezone, now)
+	if next == nil {
+		return
+	}
+
+	end := time.Unix(resetAt, 0)
+	history := &model.QuotaHistory{
+		SubjectType: subjectType,
+		SubjectID:   id,
+		Period:      period,
+		PeriodStart: previousBoundary(period, timezone, end),
+		PeriodEnd:   end,
+		QuotaTotal:  quotaTotal,
+		QuotaUsed:   quotaUsed,
+	}
+	if err := model.ResetQuotaPeriod(table, id, history, *next); err != nil {
+		log.Printf("Failed to reset quota for %s %d: %v", subjectType, id, err)
+	}
+}
@@ -5,15 +5,20 @@ import (
 	"cpa-distribution/common/utils"
 	"cpa-distribution/model"
 	"fmt"
+	"time"
 )
 
 type CreateTokenRequest struct {
-	Name          string `json:"name" binding:"required"`
-	ExpiresAt     *int64 `json:"expires_at"`
-	QuotaTotal    int64  `json:"quota_total"`
-	RateLimitRPM  int    `json:"rate_limit_rpm"`
-	AllowedModels string `json:"allowed_models"`
-	AllowedIPs    string `json:"allowed_ips"`
+	Name           string `json:"name" binding:"required"`
+	ExpiresAt      *int64 `json:"expires_at"`
+	QuotaTotal     int64  `json:"quota_total"`
+	QuotaPeriod    string `json:"quota_period"`
+	QuotaTimezone  string `json:"quota_timezone"`
+	RateLimitRPM   int    `json:"rate_limit_rpm"`
+	RateLimitTPM   int    `json:"rate_limit_tpm"`
+	MaxConcurrency int    `json:"max_concurrency"`
+	AllowedModels  string `json:"allowed_models"`
+	AllowedIPs     string `json:"allowed_ips"`
 }
 
 type CreateTokenResponse struct {
@@ -33,6 +38,14 @@ func CreateToken(userID uint, req CreateTokenRequest) (*CreateTokenResponse, err
 		return nil, fmt.Errorf("已达到密钥数量上限 (%d)", user.TokenLimit)
 	}
 
+	if err := ValidateQuotaPeriod(req.QuotaPeriod, req.QuotaTimezone); err != nil {
+		return nil, err
+	}
+	quotaPeriod := req.QuotaPeriod
+	if quotaPeriod == "" {
+		quotaPeriod = common.QuotaPeriodNone
+	}
+
 	plainKey, keyHash, keyPrefix := utils.GenerateAPIKey()
 
 	rpm := req.RateLimitRPM
@@ -46,17 +59,22 @@ func CreateToken(userID uint, req CreateTokenRequest) (*CreateTokenResponse, err
 	}
 
 	token := &model.Token{
-		UserID:        userID,
-		KeyHash:       keyHash,
-		KeyPrefix:     keyPrefix,
-		Name:          req.Name,
-		Status:        common.StatusEnabled,
-		ExpiresAt:     req.ExpiresAt,
-		QuotaTotal:    quotaTotal,
-		QuotaUsed:     0,
-		RateLimitRPM:  rpm,
-		AllowedModels: req.AllowedModels,
-		AllowedIPs:    req.AllowedIPs,
+		UserID:         userID,
+		KeyHash:        keyHash,
+		KeyPrefix:      keyPrefix,
+		Name:           req.Name,
+		Status:         common.StatusEnabled,
+		ExpiresAt:      req.ExpiresAt,
+		QuotaTotal:     quotaTotal,
+		QuotaUsed:      0,
+		QuotaPeriod:    quotaPeriod,
+		QuotaTimezone:  req.QuotaTimezone,
+		QuotaResetAt:   NextQuotaReset(quotaPeriod, req.QuotaTimezone, time.Now()),
+		RateLimitRPM:   rpm,
+		RateLimitTPM:   req.RateLimitTPM,
+		MaxConcurrency: req.MaxConcurrency,
+		AllowedModels:  req.AllowedModels,
+		AllowedIPs:     req.AllowedIPs,
 	}
 
 	if err := token.Insert(); err != nil {
@@ -70,13 +88,17 @@ func CreateToken(userID uint, req CreateTokenRequest) (*CreateTokenResponse, err
 }
 
 type UpdateTokenRequest struct {
-	Name          *string `json:"name"`
-	Status        *int    `json:"status"`
-	ExpiresAt     *int64  `json:"expires_at"`
-	QuotaTotal    *int64  `json:"quota_total"`
-	RateLimitRPM  *int    `json:"rate_limit_rpm"`
-	AllowedModels *string `json:"allowed_models"`
-	AllowedIPs    *string `json:"allowed_ips"`
+	Name           *string `json:"name"`
+	Status         *int    `json:"status"`
+	ExpiresAt      *int64  `json:"expires_at"`
+	QuotaTotal     *int64  `json:"quota_total"`
+	QuotaPeriod    *string `json:"quota_period"`
+	QuotaTimezone  *string `json:"quota_timezone"`
+	RateLimitRPM   *int    `json:"rate_limit_rpm"`
+	RateLimitTPM   *int    `json:"rate_limit_tpm"`
+	MaxConcurrency *int    `json:"max_concurrency"`
+	AllowedModels  *string `json:"allowed_models"`
+	AllowedIPs     *string `json:"allowed_ips"`
 }
 
 func UpdateToken(tokenID uint, userID uint, req UpdateTokenRequest) (*model.Token, error) {
@@ -85,29 +107,61 @@ func UpdateToken(tokenID uint, userID uint, req UpdateTokenRequest) (*model.Toke
 		return nil, fmt.Errorf("密钥不存在")
 	}
 
+	var columns []string
 	if req.Name != nil {
 		token.Name = *req.Name
+		columns = append(columns, "name")
 	}
 	if req.Status != nil {
 		token.Status = *req.Status
+		columns = append(columns, "status")
 	}
 	if req.ExpiresAt != nil {
 		token.ExpiresAt = req.ExpiresAt
+		columns = append(columns, "expires_at")
 	}
 	if req.QuotaTotal != nil {
 		token.QuotaTotal = *req.QuotaTotal
+		columns = append(columns, "quota_total")
+	}
+	if req.QuotaPeriod != nil || req.QuotaTimezone != nil {
+		if req.QuotaPeriod != nil {
+			token.QuotaPeriod = *req.QuotaPeriod
+		}
+		if req.QuotaTimezone != nil {
+			token.QuotaTimezone = *req.QuotaTimezone
+		}
+		if err := ValidateQuotaPeriod(token.QuotaPeriod, token.QuotaTimezone); err != nil {
+			return nil, err
+		}
+		if token.QuotaPeriod == "" {
+			token.QuotaPeriod = common.QuotaPeriodNone
+		}
+		token.QuotaResetAt = NextQuotaReset(token.QuotaPeriod, token.QuotaTimezone, time.Now())
+		columns = append(columns, "quota_period", "quota_timezone", "quota_reset_at")
 	}
 	if req.RateLimitRPM != nil {
 		token.RateLimitRPM = *req.RateLimitRPM
+		columns = append(columns, "rate_limit_rpm")
+	}
+	if req.RateLimitTPM != nil {
+		token.RateLimitTPM = *req.RateLimitTPM
+		columns = append(columns, "rate_limit_tpm")
+	}
+	if req.MaxConcurrency != nil {
+		token.MaxConcurrency = *req.MaxConcurrency
+		columns = append(columns, "max_concurrency")
 	}
 	if req.AllowedModels != nil {
 		token.AllowedModels = *req.AllowedModels
+		columns = append(columns, "allowed_models")
 	}
 	if req.AllowedIPs != nil {
 		token.AllowedIPs = *req.AllowedIPs
+		columns = append(columns, "allowed_ips")
 	}
 
-	if err := token.Update(); err != nil {
+	if err := token.Update(columns...); err != nil {
 		return nil, fmt.Errorf("更新密钥失败: %w", err)
 	}
 
@@ -124,7 +178,7 @@ func ResetToken(tokenID uint, userID uint) (*CreateTokenResponse, error) {
 	token.KeyHash = keyHash
 	token.KeyPrefix = keyPrefix
 
-	if err := token.Update(); err != nil {
+	if err := token.Update("key_hash", "key_prefix"); err != nil {
 		return nil, fmt.Errorf("重置密钥失败: %w", err)
 	}
 
@@ -134,8 +188,25 @@ func ResetToken(tokenID uint, userID uint) (*CreateTokenResponse, error) {
 	}, nil
 }
 
-func IncrementUsage(tokenID uint, userID uint) {
-	model.IncrementTokenUsage(tokenID)
-	model.DB.Model(&model.User{}).Where("id = ?", userID).
-		UpdateColumn("quota_used", model.DB.Raw("quota_used + 1"))
+// IncrementUsage charges a successful request against the token and user quota
+// and deducts its cost from the user's balance. In token mode the quota charge is
+// the number of prompt and completion tokens used, otherwise every request costs 1.
+// The charge is visible to quota checks at once and written to the database in
+// the next usage flush.
+func IncrementUsage(entry model.RequestLog) {
+	charge := QuotaCharge(entry.PromptTokens, entry.CompletionTokens)
+	model.AddPendingUsage(entry.TokenID, entry.UserID, charge, entry.Cost)
+	recordUsage(usageIncrement{
+		tokenID: entry.TokenID,
+		userID:  entry.UserID,
+		quota:   charge,
+		cost:    entry.Cost,
+	})
+}
+
+func QuotaCharge(promptTokens int, completionTokens int) int64 {
+	if model.GetQuotaMode() == common.QuotaModeToken {
+		return int64(promptTokens + completionTokens)
+	}
+	return 1
 }
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"cpa-distribution/model"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryStatusCodes = "429,502,503,504"
+	maxRetryBackoff         = 10 * time.Second
+)
+
+// RetryConfig controls how often a failed upstream request is tried again.
+// Each retry walks the candidate channels again after an exponential backoff.
+type RetryConfig struct {
+	MaxRetries  int   `json:"retry_max"`
+	BackoffMs   int   `json:"retry_backoff_ms"`
+	StatusCodes []int `json:"retry_status_codes"`
+}
+
+func GetRetryConfig() RetryConfig {
+	cfg := RetryConfig{
+		MaxRetries: model.GetSettingInt("retry_max", 2),
+		BackoffMs:  model.GetSettingInt("retry_backoff_ms", 500),
+	}
+	codes := model.GetSetting("retry_status_codes")
+	if codes == "" {
+		codes = defaultRetryStatusCodes
+	}
+	cfg.StatusCodes, _ = ParseStatusCodes(codes)
+	return cfg
+}
+
+// ParseStatusCodes parses a comma-separated list of HTTP status codes.
+func ParseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("无效的状态码: %s", part)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Retryable reports whether a response with this status should be retried.
+func (c RetryConfig) Retryable(status int) bool {
+	return slices.Contains(c.StatusCodes, status)
+}
+
+// Backoff returns the delay before retry round n (starting at 1): the base
+// delay doubled per round plus up to 50% jitter, capped at 10s.
+func (c RetryConfig) Backoff(n int) time.Duration {
+	base := time.Duration(c.BackoffMs) * time.Millisecond
+	if base <= 0 {
+		return 0
+	}
+	delay := base << (n - 1)
+	if delay <= 0 || delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	delay += time.Duration(rand.Int64N(int64(delay/2) + 1))
+	return min(delay, maxRetryBackoff)
+}
+
+// TimeoutConfig holds the upstream timeouts in seconds; 0 means no limit.
+type TimeoutConfig struct {
+	Dial           int `json:"upstream_dial_timeout"`
+	TLSHandshake   int `json:"upstream_tls_timeout"`
+	ResponseHeader int `json:"upstream_response_header_timeout"`
+	StreamIdle     int `json:"upstream_stream_idle_timeout"`
+}
+
+func GetTimeoutConfig() TimeoutConfig {
+	return TimeoutConfig{
+		Dial:           model.GetSettingInt("upstream_dial_timeout", 10),
+		TLSHandshake:   model.GetSettingInt("upstream_tls_timeout", 10),
+		ResponseHeader: model.GetSettingInt("upstream_response_header_timeout", 300),
+		StreamIdle:     model.GetSettingInt("upstream_stream_idle_timeout", 120),
+	}
+}
+
+// BodyLimitConfig holds the maximum proxied body sizes in MB; 0 means no limit.
+type BodyLimitConfig struct {
+	MaxRequestMB  int `json:"max_request_body_mb"`
+	MaxResponseMB int `json:"max_response_body_mb"`
+}
+
+func GetBodyLimitConfig() BodyLimitConfig {
+	return BodyLimitConfig{
+		MaxRequestMB:  model.GetSettingInt("max_request_body_mb", 32),
+		MaxResponseMB: model.GetSettingInt("max_response_body_mb", 64),
+	}
+}
+
+func (c BodyLimitConfig) MaxRequestBytes() int64 {
+	return int64(c.MaxRequestMB) << 20
+}
+
+func (c BodyLimitConfig) MaxResponseBytes() int64 {
+	return int64(c.MaxResponseMB) << 20
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	sharedTransport     *http.Transport
+	sharedTimeoutConfig TimeoutConfig
+	transportMutex      sync.Mutex
+)
+
+// UpstreamTransport returns the pooled transport shared by proxied requests,
+// model list fetches and health probes. It is rebuilt when the timeout
+// settings change.
+func UpstreamTransport() *http.Transport {
+	cfg := GetTimeoutConfig()
+
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+
+	if sharedTransport != nil && cfg == sharedTimeoutConfig {
+		return sharedTransport
+	}
+	if sharedTransport != nil {
+		sharedTransport.CloseIdleConnections()
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cfg.Dial) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	sharedTransport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          200,
+		MaxIdleConnsPerHost:   50,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshake) * time.Second,
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeader) * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	sharedTimeoutConfig = cfg
+	return sharedTransport
+}
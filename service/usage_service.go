@@ -0,0 +1,132 @@
+package service
+
+import (
+	"cpa-distribution/model"
+	"log"
+	"time"
+)
+
+type usageIncrement struct {
+	tokenID uint
+	userID  uint
+	quota   int64
+	cost    float64
+}
+
+// Usage increments are queued and written in batches by usageConsumer, so the
+// hot path does not issue two UPDATEs per request.
+var (
+	usageChannel chan usageIncrement
+	usageStop    chan struct{}
+	usageDone    chan struct{}
+)
+
+func InitUsageService() {
+	usageChannel = make(chan usageIncrement, 1000)
+	usageStop = make(chan struct{})
+	usageDone = make(chan struct{})
+	go usageConsumer()
+}
+
+// StopUsageService writes all queued usage to the database. It should be called
+// once the server no longer accepts requests.
+func StopUsageService() {
+	close(usageStop)
+	<-usageDone
+}
+
+func recordUsage(inc usageIncrement) {
+	select {
+	case usageChannel <- inc:
+	default:
+		// Usage is billed, so write it directly rather than drop it
+		tokens := make(map[uint]*model.UsageDelta)
+		users := make(map[uint]*model.UsageDelta)
+		addUsage(tokens, users, inc)
+		flushUsage(tokens, users)
+	}
+}
+
+func usageConsumer() {
+	defer close(usageDone)
+
+	tokens := make(map[uint]*model.UsageDelta)
+	users := make(map[uint]*model.UsageDelta)
+	count := 0
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case inc := <-usageChannel:
+			addUsage(tokens, users, inc)
+			count++
+			if count >= 200 {
+				flushUsage(tokens, users)
+				count = len(tokens) + len(users)
+			}
+		case <-ticker.C:
+			if count > 0 {
+				flushUsage(tokens, users)
+				count = len(tokens) + len(users)
+			}
+		case <-usageStop:
+			for {
+				select {
+				case inc := <-usageChannel:
+					addUsage(tokens, users, inc)
+				default:
+					flushUsage(tokens, users)
+					if n := len(tokens) + len(users); n > 0 {
+						log.Printf("Failed to write usage for %d tokens/users on shutdown", n)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func addUsage(tokens map[uint]*model.UsageDelta, users map[uint]*model.UsageDelta, inc usageIncrement) {
+	td, exists := tokens[inc.tokenID]
+	if !exists {
+		td = &model.UsageDelta{}
+		tokens[inc.tokenID] = td
+	}
+	td.Quota += inc.quota
+	td.Requests++
+
+	ud, exists := users[inc.userID]
+	if !exists {
+		ud = &model.UsageDelta{}
+		users[inc.userID] = ud
+	}
+	ud.Quota += inc.quota
+	ud.Cost += inc.cost
+}
+
+// flushUsage writes the deltas to the database and removes the ones that were
+// written from the maps. Failed deltas stay in place for the next flush.
+func flushUsage(tokens map[uint]*model.UsageDelta, users map[uint]*model.UsageDelta) {
+	written := make(map[uint]*model.UsageDelta)
+	writtenUsers := make(map[uint]*model.UsageDelta)
+
+	model.BeginUsageSettle()
+	for id, d := range tokens {
+		if err := model.IncrementTokenUsage(id, d.Quota, d.Requests); err != nil {
+			log.Printf("Failed to write usage for token %d: %v", id, err)
+			continue
+		}
+		written[id] = d
+		delete(tokens, id)
+	}
+	for id, d := range users {
+		if err := model.IncrementUserUsage(id, d.Quota, d.Cost); err != nil {
+			log.Printf("Failed to write usage for user %d: %v", id, err)
+			continue
+		}
+		writtenUsers[id] = d
+		delete(users, id)
+	}
+	model.SettlePendingUsage(written, writtenUsers)
+}
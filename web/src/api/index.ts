@@ -11,6 +11,7 @@ export interface PagedResult<T> {
   total: number
   page: number
   page_size: number
+  next_cursor?: number
 }
 
 export interface UserInfo {
@@ -22,8 +23,14 @@ export interface UserInfo {
   status: number
   quota_total: number
   quota_used: number
+  quota_period: string
+  quota_timezone: string
+  quota_reset_at?: number | null
   trust_level: number
   token_limit: number
+  balance: number
+  rate_limit_tpm: number
+  max_concurrency: number
   last_login_at?: number | null
   last_login_ip?: string
 }
@@ -36,7 +43,12 @@ export interface TokenInfo {
   expires_at: number | null
   quota_total: number
   quota_used: number
+  quota_period: string
+  quota_timezone: string
+  quota_reset_at?: number | null
   rate_limit_rpm: number
+  rate_limit_tpm: number
+  max_concurrency: number
   allowed_models: string
   allowed_ips: string
   total_requests: number
@@ -56,15 +68,29 @@ export interface RequestLogInfo {
   method: string
   path: string
   model: string
+  upstream_model: string
   status_code: number
+  attempts: number
+  is_stream: boolean
   duration: number
+  first_token_time: number
+  tokens_per_second: number
   prompt_tokens: number
   completion_tokens: number
   total_tokens: number
+  cost: number
+  error_type?: string
   error_message: string
   created_at: string
 }
 
+export const quotaPeriodOptions = [
+  { value: 'none', label: '不重置' },
+  { value: 'daily', label: '每天' },
+  { value: 'weekly', label: '每周' },
+  { value: 'monthly', label: '每月' },
+]
+
 export interface IPBanInfo {
   id: number
   ip: string
@@ -77,8 +103,11 @@ export interface IPBanInfo {
 export interface LogStats {
   total_requests: number
   total_tokens: number
+  total_cost: number
   today_requests: number
   today_tokens: number
+  today_cost: number
+  spool_depth?: number
 }
 
 export interface DashboardData {
@@ -88,17 +117,81 @@ export interface DashboardData {
     role: number
     quota_total: number
     quota_used: number
+    balance: number
   }
   stats: LogStats
   token_count: number
   global_stats?: LogStats
   user_count?: number
-  trend?: Array<{ date: string; count: number }>
-  model_distribution?: Array<{ model: string; count: number }>
+  trend?: Array<{ date: string; count: number; tokens: number; cost: number }>
+  model_distribution?: Array<{ model: string; count: number; cost: number }>
+  model_latency?: LatencyStats[]
+  channel_latency?: LatencyStats[]
+}
+
+export interface LatencyStats {
+  model?: string
+  channel_id: number
+  requests: number
+  ttft_p50: number
+  ttft_p95: number
+  duration_p50: number
+  duration_p95: number
+  tps_p50: number
+  tps_p95: number
+}
+
+export type AnalyticsGranularity = 'hour' | 'day' | 'month'
+export type AnalyticsGroupBy = '' | 'model' | 'user' | 'token' | 'status_class' | 'ip'
+export type AnalyticsMetric = 'requests' | 'tokens' | 'error_rate' | 'p50_latency' | 'p95_latency'
+
+export interface AnalyticsParams {
+  start?: number
+  end?: number
+  granularity?: AnalyticsGranularity
+  group_by?: AnalyticsGroupBy
+  metrics?: string
+  limit?: number
+  user_id?: number
+}
+
+export type AnalyticsPoint = { time: string } & Partial<Record<AnalyticsMetric, number>>
+
+export interface AnalyticsResult {
+  start: number
+  end: number
+  granularity: AnalyticsGranularity
+  group_by: AnalyticsGroupBy
+  metrics: AnalyticsMetric[]
+  buckets: string[]
+  series: Array<{ key: string; points: AnalyticsPoint[] }>
 }
 
 export type SettingsMap = Record<string, string>
 
+export interface ChannelHealth {
+  channel_id: number
+  name: string
+  state: 'closed' | 'open' | 'half_open'
+  consecutive_failures: number
+  last_error: string
+  last_failure_at: string | null
+  opened_at: string | null
+  last_probe_at: string | null
+  last_probe_ok: boolean
+  last_probe_latency: number
+}
+
+export interface UpstreamStatus {
+  config: {
+    health_check_interval: number
+    health_check_path: string
+    breaker_failure_threshold: number
+    breaker_cooldown: number
+  }
+  channels: ChannelHealth[]
+}
+
 const api = axios.create({
   baseURL: import.meta.env.VITE_API_BASE || '',
   timeout: 30000,
@@ -142,6 +235,20 @@ const request = {
   },
 }
 
+// downloadExport fetches an export with the auth header and saves it under
+// the file name sent by the server.
+async function downloadExport(url: string, params: Record<string, unknown>) {
+  const response = await api.get<Blob>(url, { params, responseType: 'blob', timeout: 0 })
+  const disposition = String(response.headers['content-disposition'] ?? '')
+  const filename = disposition.match(/filename="(.+)"/)?.[1] ?? 'export'
+  const href = URL.createObjectURL(response.data)
+  const link = document.createElement('a')
+  link.href = href
+  link.download = filename
+  link.click()
+  URL.revokeObjectURL(href)
+}
+
 export function getErrorMessage(error: unknown, fallback: string): string {
   if (typeof error !== 'object' || error === null) {
     return fallback
@@ -179,9 +286,12 @@ export const resetToken = (id: number) => request.post<TokenCreateResult>(`/api/
 export const getLogs = (params: Record<string, unknown>) =>
   request.get<PagedResult<RequestLogInfo>>('/api/logs', { params })
 export const getLogStats = () => request.get<LogStats>('/api/logs/stats')
+export const exportLogs = (params: Record<string, unknown>) => downloadExport('/api/logs/export', params)
 
 // Dashboard
 export const getDashboard = () => request.get<DashboardData>('/api/dashboard')
+export const getAnalytics = (params: AnalyticsParams) =>
+  request.get<AnalyticsResult>('/api/analytics', { params })
 
 // Admin: Users
 export const getUsers = (params: Record<string, unknown>) =>
@@ -201,7 +311,14 @@ export const getAdminLogs = (params: Record<string, unknown>) =>
   request.get<PagedResult<RequestLogInfo>>('/api/admin/logs', { params })
 export const getAdminLogStats = () => request.get<LogStats>('/api/admin/logs/stats')
 export const cleanLogs = (days: number) => request.delete<{ deleted: number }>('/api/admin/logs', { data: { days } })
+export const exportAdminLogs = (params: Record<string, unknown>) =>
+  downloadExport('/api/admin/logs/export', params)
+export const getAdminAnalytics = (params: AnalyticsParams) =>
+  request.get<AnalyticsResult>('/api/admin/analytics', { params })
 
 // Admin: Settings
 export const getSettings = () => request.get<SettingsMap>('/api/admin/settings')
 export const updateSettings = (data: SettingsMap) => request.put<null>('/api/admin/settings', data)
+
+// Admin: Upstream
+export const getUpstreamStatus = () => request.get<UpstreamStatus>('/api/admin/upstream/status')
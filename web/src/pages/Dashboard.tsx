@@ -1,17 +1,152 @@
-import { useEffect, useState } from 'react'
-import { Card, Col, Row, Statistic, Typography, Table, Spin } from 'antd'
+import { useEffect, useMemo, useState } from 'react'
+import { Card, Col, Row, Statistic, Typography, Table, Spin, Tag, Tooltip, Select, Space, Empty } from 'antd'
+import { Line } from '@ant-design/charts'
+import type { ColumnsType } from 'antd/es/table'
 import { ApiOutlined, ThunderboltOutlined, ClockCircleOutlined, KeyOutlined } from '@ant-design/icons'
-import { getDashboard, type DashboardData } from '../api'
+import dayjs from 'dayjs'
+import {
+  getAdminAnalytics, getAnalytics, getDashboard, getUpstreamStatus,
+  type AnalyticsGranularity, type AnalyticsGroupBy, type AnalyticsMetric, type AnalyticsResult,
+  type ChannelHealth, type DashboardData, type LatencyStats, type UpstreamStatus,
+} from '../api'
 import { useUserStore } from '../store/userStore'
 
 const { Title } = Typography
 
+const latencyColumns: ColumnsType<LatencyStats> = [
+  { title: '请求数', dataIndex: 'requests', key: 'requests' },
+  {
+    title: '首字 P50 / P95 (ms)', key: 'ttft',
+    render: (_, r) => `${r.ttft_p50} / ${r.ttft_p95}`,
+  },
+  {
+    title: '耗时 P50 / P95 (ms)', key: 'duration',
+    render: (_, r) => `${r.duration_p50} / ${r.duration_p95}`,
+  },
+  {
+    title: '速度 P50 / P95 (t/s)', key: 'tps',
+    render: (_, r) => `${r.tps_p50.toFixed(1)} / ${r.tps_p95.toFixed(1)}`,
+  },
+]
+
+const breakerStates: Record<ChannelHealth['state'], { color: string; label: string }> = {
+  closed: { color: 'green', label: '正常' },
+  half_open: { color: 'orange', label: '半开' },
+  open: { color: 'red', label: '熔断' },
+}
+
+const formatTime = (v: string | null) => v ? dayjs(v).format('MM-DD HH:mm:ss') : '-'
+
+const channelHealthColumns: ColumnsType<ChannelHealth> = [
+  { title: '渠道 ID', dataIndex: 'channel_id', key: 'channel_id' },
+  { title: '名称', dataIndex: 'name', key: 'name' },
+  {
+    title: '熔断状态', dataIndex: 'state', key: 'state',
+    render: (v: ChannelHealth['state']) => <Tag color={breakerStates[v]?.color}>{breakerStates[v]?.label || v}</Tag>,
+  },
+  { title: '连续失败', dataIndex: 'consecutive_failures', key: 'consecutive_failures' },
+  {
+    title: '最近探测', key: 'probe',
+    render: (_, r) => r.last_probe_at
+      ? <span>{formatTime(r.last_probe_at)} <Tag color={r.last_probe_ok ? 'green' : 'red'}>{r.last_probe_ok ? `${r.last_probe_latency}ms` : '失败'}</Tag></span>
+      : '-',
+  },
+  {
+    title: '最近错误', key: 'last_error',
+    render: (_, r) => r.last_error
+      ? <Tooltip title={r.last_error}>{formatTime(r.last_failure_at)}</Tooltip>
+      : '-',
+  },
+]
+
+const analyticsRanges: Record<string, { label: string; seconds: number; granularity: AnalyticsGranularity }> = {
+  '24h': { label: '近24小时', seconds: 24 * 3600, granularity: 'hour' },
+  '7d': { label: '近7天', seconds: 7 * 86400, granularity: 'day' },
+  '30d': { label: '近30天', seconds: 30 * 86400, granularity: 'day' },
+  '1y': { label: '近一年', seconds: 365 * 86400, granularity: 'month' },
+}
+
+const analyticsMetrics: { value: AnalyticsMetric; label: string }[] = [
+  { value: 'requests', label: '请求数' },
+  { value: 'tokens', label: 'Token 用量' },
+  { value: 'error_rate', label: '错误率' },
+  { value: 'p50_latency', label: '耗时 P50 (ms)' },
+  { value: 'p95_latency', label: '耗时 P95 (ms)' },
+]
+
+function UsageAnalytics({ isAdmin }: { isAdmin: boolean }) {
+  const [range, setRange] = useState('7d')
+  const [groupBy, setGroupBy] = useState<AnalyticsGroupBy>('')
+  const [metric, setMetric] = useState<AnalyticsMetric>('requests')
+  const [result, setResult] = useState<AnalyticsResult | null>(null)
+  const [loading, setLoading] = useState(true)
+
+  const groupByOptions = [
+    { value: '', label: '不分组' },
+    { value: 'model', label: '按模型' },
+    ...(isAdmin ? [{ value: 'user', label: '按用户' }] : []),
+    { value: 'token', label: '按密钥' },
+    { value: 'status_class', label: '按状态码' },
+    { value: 'ip', label: '按 IP' },
+  ]
+
+  useEffect(() => {
+    const { seconds, granularity } = analyticsRanges[range]
+    const end = Math.floor(Date.now() / 1000)
+    const params = { start: end - seconds, end, granularity, group_by: groupBy, metrics: metric }
+    const load = isAdmin ? getAdminAnalytics : getAnalytics
+    load(params).then((res) => {
+      setResult(res.data)
+      setLoading(false)
+    }).catch(() => setLoading(false))
+  }, [isAdmin, range, groupBy, metric])
+
+  const points = useMemo(() => (result?.series || []).flatMap((s) =>
+    s.points.map((p) => ({ time: p.time, key: s.key || '-', value: p[metric] ?? 0 })),
+  ), [result, metric])
+
+  return (
+    <Card
+      title="用量分析"
+      style={{ marginTop: 16 }}
+      extra={
+        <Space wrap>
+          <Select
+            value={range}
+            onChange={setRange}
+            style={{ width: 120 }}
+            options={Object.entries(analyticsRanges).map(([value, r]) => ({ value, label: r.label }))}
+          />
+          <Select value={groupBy} onChange={setGroupBy} style={{ width: 120 }} options={groupByOptions} />
+          <Select value={metric} onChange={setMetric} style={{ width: 140 }} options={analyticsMetrics} />
+        </Space>
+      }
+    >
+      <Spin spinning={loading}>
+        {points.length > 0 ? (
+          <Line
+            data={points}
+            xField="time"
+            yField="value"
+            colorField="key"
+            height={300}
+          />
+        ) : (
+          <Empty style={{ padding: 48 }} />
+        )}
+      </Spin>
+    </Card>
+  )
+}
+
 export default function Dashboard() {
   const [data, setData] = useState<DashboardData | null>(null)
   const [loading, setLoading] = useState(true)
   const { user } = useUserStore()
   const isAdmin = user && user.role >= 10
 
+  const [upstream, setUpstream] = useState<UpstreamStatus | null>(null)
+
   useEffect(() => {
     getDashboard().then((res) => {
       setData(res.data)
@@ -19,6 +154,11 @@ export default function Dashboard() {
     }).catch(() => setLoading(false))
   }, [])
 
+  useEffect(() => {
+    if (!isAdmin) return
+    getUpstreamStatus().then((res) => setUpstream(res.data)).catch(() => {})
+  }, [isAdmin])
+
   if (loading) return <Spin size="large" style={{ display: 'block', margin: '100px auto' }} />
   if (!data) return null
 
@@ -69,23 +209,40 @@ export default function Dashboard() {
       {data.user && (
         <Card style={{ marginTop: 16 }}>
           <Row gutter={16}>
-            <Col span={12}>
+            <Col span={6}>
               <Statistic
                 title="配额使用"
                 value={data.user.quota_used}
                 suffix={`/ ${data.user.quota_total === -1 ? '无限' : data.user.quota_total}`}
               />
             </Col>
-            <Col span={12}>
+            <Col span={6}>
               <Statistic
                 title="今日 Token"
                 value={data.stats?.today_tokens || 0}
               />
             </Col>
+            <Col span={6}>
+              <Statistic
+                title="余额"
+                value={data.user.balance || 0}
+                precision={4}
+              />
+            </Col>
+            <Col span={6}>
+              <Statistic
+                title="今日消费 / 总消费"
+                value={data.stats?.today_cost || 0}
+                precision={4}
+                suffix={`/ ${(data.stats?.total_cost || 0).toFixed(4)}`}
+              />
+            </Col>
           </Row>
         </Card>
       )}
 
+      <UsageAnalytics isAdmin={!!isAdmin} />
+
       {isAdmin && (
         <>
           <Row gutter={[16, 16]} style={{ marginTop: 16 }}>
@@ -93,6 +250,7 @@ export default function Dashboard() {
               <Card title="全局统计">
                 <Statistic title="全局总请求" value={data.global_stats?.total_requests || 0} />
                 <Statistic title="全局总 Token" value={data.global_stats?.total_tokens || 0} style={{ marginTop: 16 }} />
+                <Statistic title="全局总消费" value={data.global_stats?.total_cost || 0} precision={4} style={{ marginTop: 16 }} />
                 <Statistic title="用户总数" value={data.user_count || 0} style={{ marginTop: 16 }} />
               </Card>
             </Col>
@@ -114,6 +272,18 @@ export default function Dashboard() {
             </Col>
           </Row>
 
+          {upstream && upstream.channels.length > 0 && (
+            <Card title="渠道健康状态" style={{ marginTop: 16 }}>
+              <Table
+                dataSource={upstream.channels}
+                columns={channelHealthColumns}
+                pagination={false}
+                size="small"
+                rowKey="channel_id"
+              />
+            </Card>
+          )}
+
           {data.model_distribution && data.model_distribution.length > 0 && (
             <Card title="模型分布" style={{ marginTop: 16 }}>
               <Table
@@ -121,6 +291,10 @@ export default function Dashboard() {
                 columns={[
                   { title: '模型', dataIndex: 'model', key: 'model' },
                   { title: '调用次数', dataIndex: 'count', key: 'count' },
+                  {
+                    title: '消费', dataIndex: 'cost', key: 'cost',
+                    render: (v: number) => (v ?? 0).toFixed(4),
+                  },
                 ]}
                 pagination={false}
                 size="small"
@@ -128,6 +302,30 @@ export default function Dashboard() {
               />
             </Card>
           )}
+
+          {data.model_latency && data.model_latency.length > 0 && (
+            <Card title="模型流式性能 (近24小时)" style={{ marginTop: 16 }}>
+              <Table
+                dataSource={data.model_latency}
+                columns={[{ title: '模型', dataIndex: 'model', key: 'model' }, ...latencyColumns]}
+                pagination={false}
+                size="small"
+                rowKey="model"
+              />
+            </Card>
+          )}
+
+          {data.channel_latency && data.channel_latency.length > 0 && (
+            <Card title="渠道流式性能 (近24小时)" style={{ marginTop: 16 }}>
+              <Table
+                dataSource={data.channel_latency}
+                columns={[{ title: '渠道 ID', dataIndex: 'channel_id', key: 'channel_id' }, ...latencyColumns]}
+                pagination={false}
+                size="small"
+                rowKey="channel_id"
+              />
+            </Card>
+          )}
         </>
       )}
     </div>
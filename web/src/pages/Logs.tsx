@@ -1,7 +1,8 @@
-import { useCallback, useEffect, useState } from 'react'
-import { Table, Card, Input, Typography, Tag, Space } from 'antd'
+import { useCallback, useEffect, useMemo, useState } from 'react'
+import { Table, Card, Input, Typography, Tag, Space, Tooltip, Dropdown, Button, Checkbox, message } from 'antd'
 import type { ColumnsType } from 'antd/es/table'
-import { getLogs, type RequestLogInfo } from '../api'
+import { DownloadOutlined } from '@ant-design/icons'
+import { exportLogs, getErrorMessage, getLogs, type RequestLogInfo } from '../api'
 import dayjs from 'dayjs'
 
 const { Title } = Typography
@@ -13,17 +14,27 @@ export default function Logs() {
   const [page, setPage] = useState(1)
   const [pageSize, setPageSize] = useState(20)
   const [modelFilter, setModelFilter] = useState('')
+  const [statusFilter, setStatusFilter] = useState('')
+  const [errorFilter, setErrorFilter] = useState('')
+  const [errorsOnly, setErrorsOnly] = useState(false)
+
+  const filters = useMemo(() => ({
+    model: modelFilter || undefined,
+    status: statusFilter || undefined,
+    error: errorFilter || undefined,
+    errors_only: errorsOnly || undefined,
+  }), [modelFilter, statusFilter, errorFilter, errorsOnly])
 
   const fetchLogs = useCallback(async (showLoading = false) => {
     if (showLoading) {
       setLoading(true)
     }
-    getLogs({ page, page_size: pageSize, model: modelFilter || undefined }).then((res) => {
+    getLogs({ page, page_size: pageSize, ...filters }).then((res) => {
       setLogs(res.data?.list || [])
       setTotal(res.data?.total || 0)
       setLoading(false)
     }).catch(() => setLoading(false))
-  }, [page, pageSize, modelFilter])
+  }, [page, pageSize, filters])
 
   useEffect(() => {
     const timer = window.setTimeout(() => {
@@ -32,27 +43,55 @@ export default function Logs() {
     return () => window.clearTimeout(timer)
   }, [fetchLogs])
 
+  const handleExport = async (key: string) => {
+    const [report, format] = key.split('.')
+    try {
+      await exportLogs({ report, format, ...filters })
+    } catch (error) {
+      message.error(getErrorMessage(error, '导出失败'))
+    }
+  }
+
   const columns: ColumnsType<RequestLogInfo> = [
     {
       title: '时间', dataIndex: 'created_at', key: 'created_at', width: 160,
       render: (v: string) => dayjs(v).format('MM-DD HH:mm:ss'),
     },
-    { title: '模型', dataIndex: 'model', key: 'model', width: 200 },
+    {
+      title: '模型', dataIndex: 'model', key: 'model', width: 200,
+      render: (v: string, r) => r.upstream_model && r.upstream_model !== v ? `${v} → ${r.upstream_model}` : v,
+    },
     {
       title: '状态', dataIndex: 'status_code', key: 'status_code', width: 80,
-      render: (v: number) => (
-        <Tag color={v >= 200 && v < 300 ? 'green' : v >= 400 ? 'red' : 'orange'}>{v}</Tag>
+      render: (v: number, r) => (
+        <Tooltip title={r.attempts > 1 ? `上游尝试 ${r.attempts} 次` : undefined}>
+          <Tag color={v >= 200 && v < 300 ? 'green' : v >= 400 ? 'red' : 'orange'}>
+            {v}{r.attempts > 1 ? ` ×${r.attempts}` : ''}
+          </Tag>
+        </Tooltip>
       ),
     },
     { title: '耗时(ms)', dataIndex: 'duration', key: 'duration', width: 100 },
+    {
+      title: '首字(ms)', dataIndex: 'first_token_time', key: 'first_token_time', width: 100,
+      render: (v: number, r) => r.is_stream && v > 0 ? v : '-',
+    },
+    {
+      title: '速度(t/s)', dataIndex: 'tokens_per_second', key: 'tokens_per_second', width: 100,
+      render: (v: number) => v > 0 ? v.toFixed(1) : '-',
+    },
     { title: '输入', dataIndex: 'prompt_tokens', key: 'prompt_tokens', width: 80 },
     { title: '输出', dataIndex: 'completion_tokens', key: 'completion_tokens', width: 80 },
     { title: '总计', dataIndex: 'total_tokens', key: 'total_tokens', width: 80 },
+    {
+      title: '费用', dataIndex: 'cost', key: 'cost', width: 100,
+      render: (v: number) => (v ?? 0).toFixed(6),
+    },
     { title: 'IP', dataIndex: 'request_ip', key: 'request_ip', width: 140 },
     { title: '路径', dataIndex: 'path', key: 'path', ellipsis: true },
     {
       title: '错误', dataIndex: 'error_message', key: 'error_message', width: 200,
-      render: (v: string) => v ? <Tag color="red">{v}</Tag> : '-',
+      render: (v: string, r) => v ? <Tag color={r.error_type === 'timeout' ? 'orange' : 'red'}>{v}</Tag> : '-',
     },
   ]
 
@@ -69,6 +108,35 @@ export default function Logs() {
             allowClear
             style={{ width: 200 }}
           />
+          <Input
+            placeholder="状态码，如 429 或 5xx"
+            value={statusFilter}
+            onChange={(e) => { setStatusFilter(e.target.value.trim()); setPage(1) }}
+            allowClear
+            style={{ width: 180 }}
+          />
+          <Input
+            placeholder="错误信息包含"
+            value={errorFilter}
+            onChange={(e) => { setErrorFilter(e.target.value); setPage(1) }}
+            allowClear
+            style={{ width: 200 }}
+          />
+          <Checkbox checked={errorsOnly} onChange={(e) => { setErrorsOnly(e.target.checked); setPage(1) }}>
+            仅错误
+          </Checkbox>
+          <Dropdown
+            menu={{
+              items: [
+                { key: 'logs.csv', label: '导出日志 (CSV)' },
+                { key: 'logs.jsonl', label: '导出日志 (JSONL)' },
+                { key: 'monthly.csv', label: '月度用量报表 (CSV)' },
+              ],
+              onClick: ({ key }) => { void handleExport(key) },
+            }}
+          >
+            <Button icon={<DownloadOutlined />}>导出</Button>
+          </Dropdown>
         </Space>
       </Card>
 
@@ -1,5 +1,5 @@
 import { useEffect, useState } from 'react'
-import { Card, Form, Input, Button, Typography, message, Divider } from 'antd'
+import { Card, Form, Input, Button, Typography, message, Divider, Select } from 'antd'
 import { getErrorMessage, getSettings, updateSettings, type SettingsMap } from '../api'
 
 const { Title } = Typography
@@ -7,11 +7,13 @@ const { Title } = Typography
 export default function Settings() {
   const [loading, setLoading] = useState(true)
   const [saving, setSaving] = useState(false)
+  const [settings, setSettings] = useState<SettingsMap>({})
   const [form] = Form.useForm()
 
   useEffect(() => {
     getSettings().then((res) => {
       form.setFieldsValue(res.data || {})
+      setSettings(res.data || {})
       setLoading(false)
     }).catch(() => setLoading(false))
   }, [form])
@@ -66,9 +68,85 @@ export default function Settings() {
           <Form.Item name="default_quota" label="新用户默认配额">
             <Input placeholder="1000" />
           </Form.Item>
-          <Form.Item name="log_retention_days" label="日志保留天数">
+          <Form.Item
+            name="log_retention_days"
+            label="日志保留天数（0 为永久保留）"
+            extra={settings.log_retention_last_run
+              ? `上次清理：${new Date(Number(settings.log_retention_last_run) * 1000).toLocaleString()}，删除 ${settings.log_retention_last_deleted || 0} 条`
+              : undefined}
+          >
             <Input placeholder="30" />
           </Form.Item>
+          <Form.Item name="quota_mode" label="配额计费模式">
+            <Select
+              placeholder="按请求次数"
+              options={[
+                { value: 'request', label: '按请求次数' },
+                { value: 'token', label: '按 Token 数' },
+              ]}
+            />
+          </Form.Item>
+
+          <Divider>计费配置</Divider>
+          <Form.Item name="billing_enabled" label="余额不足时拒绝请求">
+            <Select
+              placeholder="关闭"
+              options={[
+                { value: 'false', label: '关闭' },
+                { value: 'true', label: '开启' },
+              ]}
+            />
+          </Form.Item>
+          <Form.Item name="default_balance" label="新用户默认余额">
+            <Input placeholder="0" />
+          </Form.Item>
+
+          <Divider>上游健康检查</Divider>
+          <Form.Item name="health_check_interval" label="探测间隔（秒，0 为关闭）">
+            <Input placeholder="60" />
+          </Form.Item>
+          <Form.Item name="health_check_path" label="探测路径">
+            <Input placeholder="/v1/models" />
+          </Form.Item>
+          <Form.Item name="breaker_failure_threshold" label="熔断阈值（连续失败次数，0 为关闭）">
+            <Input placeholder="5" />
+          </Form.Item>
+          <Form.Item name="breaker_cooldown" label="熔断冷却时间（秒）">
+            <Input placeholder="30" />
+          </Form.Item>
+
+          <Divider>上游重试</Divider>
+          <Form.Item name="retry_max" label="最大重试次数（0 为不重试）">
+            <Input placeholder="2" />
+          </Form.Item>
+          <Form.Item name="retry_backoff_ms" label="重试退避基准（毫秒）">
+            <Input placeholder="500" />
+          </Form.Item>
+          <Form.Item name="retry_status_codes" label="需重试的状态码（逗号分隔）">
+            <Input placeholder="429,502,503,504" />
+          </Form.Item>
+
+          <Divider>上游超时</Divider>
+          <Form.Item name="upstream_dial_timeout" label="连接超时（秒）">
+            <Input placeholder="10" />
+          </Form.Item>
+          <Form.Item name="upstream_tls_timeout" label="TLS 握手超时（秒）">
+            <Input placeholder="10" />
+          </Form.Item>
+          <Form.Item name="upstream_response_header_timeout" label="响应头超时（秒）">
+            <Input placeholder="300" />
+          </Form.Item>
+          <Form.Item name="upstream_stream_idle_timeout" label="流式空闲超时（秒，0 为不限制）">
+            <Input placeholder="120" />
+          </Form.Item>
+
+          <Divider>请求大小限制</Divider>
+          <Form.Item name="max_request_body_mb" label="最大请求体（MB，0 为不限制）">
+            <Input placeholder="32" />
+          </Form.Item>
+          <Form.Item name="max_response_body_mb" label="最大非流式响应（MB，0 为不限制）">
+            <Input placeholder="64" />
+          </Form.Item>
 
           <Form.Item>
             <Button type="primary" htmlType="submit" loading={saving}>
@@ -2,7 +2,7 @@ import { useCallback, useEffect, useState } from 'react'
 import { Table, Button, Modal, Form, Input, InputNumber, Space, Tag, Typography, message, Popconfirm, Select } from 'antd'
 import type { ColumnsType } from 'antd/es/table'
 import { PlusOutlined, CopyOutlined, ReloadOutlined, DeleteOutlined, EditOutlined } from '@ant-design/icons'
-import { createToken, deleteToken, getErrorMessage, getTokens, resetToken, updateToken, type TokenInfo } from '../api'
+import { createToken, deleteToken, getErrorMessage, getTokens, quotaPeriodOptions, resetToken, updateToken, type TokenInfo } from '../api'
 import dayjs from 'dayjs'
 
 const { Title, Text, Paragraph } = Typography
@@ -10,7 +10,11 @@ const { Title, Text, Paragraph } = Typography
 interface CreateTokenFormValues {
   name: string
   quota_total?: number
+  quota_period?: string
+  quota_timezone?: string
   rate_limit_rpm?: number
+  rate_limit_tpm?: number
+  max_concurrency?: number
   allowed_models?: string
   allowed_ips?: string
 }
@@ -19,7 +23,11 @@ interface EditTokenFormValues {
   name?: string
   status?: number
   quota_total?: number
+  quota_period?: string
+  quota_timezone?: string
   rate_limit_rpm?: number
+  rate_limit_tpm?: number
+  max_concurrency?: number
   allowed_models?: string
   allowed_ips?: string
 }
@@ -143,7 +151,11 @@ export default function Tokens() {
               name: record.name,
               status: record.status,
               quota_total: record.quota_total,
+              quota_period: record.quota_period || 'none',
+              quota_timezone: record.quota_timezone,
               rate_limit_rpm: record.rate_limit_rpm,
+              rate_limit_tpm: record.rate_limit_tpm,
+              max_concurrency: record.max_concurrency,
               allowed_models: record.allowed_models,
               allowed_ips: record.allowed_ips,
             })
@@ -191,9 +203,21 @@ export default function Tokens() {
           <Form.Item name="quota_total" label="配额" initialValue={-1}>
             <InputNumber style={{ width: '100%' }} placeholder="-1 表示跟随用户" />
           </Form.Item>
+          <Form.Item name="quota_period" label="配额重置周期" initialValue="none">
+            <Select options={quotaPeriodOptions} />
+          </Form.Item>
+          <Form.Item name="quota_timezone" label="重置时区（留空使用服务器时区）">
+            <Input placeholder="Asia/Shanghai" />
+          </Form.Item>
           <Form.Item name="rate_limit_rpm" label="每分钟请求上限" initialValue={60}>
             <InputNumber style={{ width: '100%' }} min={0} />
           </Form.Item>
+          <Form.Item name="rate_limit_tpm" label="每分钟 Token 上限（0 表示跟随用户）" initialValue={0}>
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
+          <Form.Item name="max_concurrency" label="最大并发数（0 表示跟随用户）" initialValue={0}>
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
           <Form.Item name="allowed_models" label="允许模型（逗号分隔，留空不限）">
             <Input placeholder="gpt-4o,claude-3-5-sonnet" />
           </Form.Item>
@@ -223,9 +247,21 @@ export default function Tokens() {
           <Form.Item name="quota_total" label="配额">
             <InputNumber style={{ width: '100%' }} />
           </Form.Item>
+          <Form.Item name="quota_period" label="配额重置周期">
+            <Select options={quotaPeriodOptions} />
+          </Form.Item>
+          <Form.Item name="quota_timezone" label="重置时区（留空使用服务器时区）">
+            <Input placeholder="Asia/Shanghai" />
+          </Form.Item>
           <Form.Item name="rate_limit_rpm" label="RPM">
             <InputNumber style={{ width: '100%' }} min={0} />
           </Form.Item>
+          <Form.Item name="rate_limit_tpm" label="TPM">
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
+          <Form.Item name="max_concurrency" label="最大并发数">
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
           <Form.Item name="allowed_models" label="允许模型">
             <Input />
           </Form.Item>
@@ -1,7 +1,7 @@
 import { useCallback, useEffect, useState } from 'react'
-import { Table, Tag, Button, Modal, Form, InputNumber, Select, Typography, message } from 'antd'
+import { Table, Tag, Button, Modal, Form, Input, InputNumber, Select, Typography, message } from 'antd'
 import type { ColumnsType } from 'antd/es/table'
-import { getErrorMessage, getUsers, updateUser, type UserInfo } from '../api'
+import { getErrorMessage, getUsers, quotaPeriodOptions, updateUser, type UserInfo } from '../api'
 import dayjs from 'dayjs'
 
 const { Title } = Typography
@@ -45,12 +45,17 @@ export default function Users() {
       role: record.role,
       status: record.status,
       quota_total: record.quota_total,
+      quota_period: record.quota_period || 'none',
+      quota_timezone: record.quota_timezone,
       token_limit: record.token_limit,
+      balance: record.balance,
+      rate_limit_tpm: record.rate_limit_tpm,
+      max_concurrency: record.max_concurrency,
     })
     setEditModalOpen(true)
   }
 
-  const handleUpdate = async (values: Record<string, number>) => {
+  const handleUpdate = async (values: Record<string, number | string>) => {
     if (!editingUser) {
       return
     }
@@ -82,6 +87,10 @@ export default function Users() {
       render: (_, r) => `${r.quota_used} / ${r.quota_total === -1 ? '∞' : r.quota_total}`,
     },
     { title: '密钥上限', dataIndex: 'token_limit', key: 'token_limit', width: 80 },
+    {
+      title: '余额', dataIndex: 'balance', key: 'balance', width: 100,
+      render: (v: number) => (v ?? 0).toFixed(4),
+    },
     {
       title: '最后登录', dataIndex: 'last_login_at', key: 'last_login_at',
       render: (v: number | null) => v ? dayjs.unix(v).format('YYYY-MM-DD HH:mm') : '-',
@@ -139,9 +148,24 @@ export default function Users() {
           <Form.Item name="quota_total" label="总配额（-1=无限）">
             <InputNumber style={{ width: '100%' }} />
           </Form.Item>
+          <Form.Item name="quota_period" label="配额重置周期">
+            <Select options={quotaPeriodOptions} />
+          </Form.Item>
+          <Form.Item name="quota_timezone" label="重置时区（留空使用服务器时区）">
+            <Input placeholder="Asia/Shanghai" />
+          </Form.Item>
           <Form.Item name="token_limit" label="密钥数量上限">
             <InputNumber style={{ width: '100%' }} min={1} />
           </Form.Item>
+          <Form.Item name="balance" label="余额">
+            <InputNumber style={{ width: '100%' }} precision={4} />
+          </Form.Item>
+          <Form.Item name="rate_limit_tpm" label="默认每分钟 Token 上限（0=不限）">
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
+          <Form.Item name="max_concurrency" label="默认最大并发数（0=不限）">
+            <InputNumber style={{ width: '100%' }} min={0} />
+          </Form.Item>
         </Form>
       </Modal>
     </div>